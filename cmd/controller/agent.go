@@ -0,0 +1,81 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/incidentassistant/k8s-agent/pkg/watcher"
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// version is the agent version, set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// agentInfo describes this run of the agent for its registration with the hub.
+func agentInfo(clientset kubernetes.Interface, agentID, cluster string, capabilities []string) *eventpb.AgentInfo {
+	info := &eventpb.AgentInfo{
+		AgentId:      agentID,
+		AgentVersion: version,
+		ClusterId:    cluster,
+		ClusterName:  os.Getenv("CLUSTER_NAME"),
+		Capabilities: capabilities,
+	}
+	if serverVersion, err := clientset.Discovery().ServerVersion(); err == nil {
+		info.KubernetesVersion = serverVersion.GitVersion
+	} else {
+		log.Printf("Error reading the Kubernetes server version: %v", err)
+	}
+	return info
+}
+
+// clusterID identifies the cluster by the UID of its kube-system namespace, which is
+// stable for the lifetime of the cluster and unique across clusters.
+func clusterID(clientset kubernetes.Interface) string {
+	namespace, err := clientset.CoreV1().Namespaces().Get(context.Background(), metav1.NamespaceSystem, metav1.GetOptions{})
+	if err != nil {
+		log.Printf("Error reading the cluster ID: %v", err)
+		return ""
+	}
+	return string(namespace.UID)
+}
+
+// watchedResources returns the watch state of every watched resource, sorted by resource.
+func watchedResources() []*eventpb.WatchedResource {
+	var resources []*eventpb.WatchedResource
+	for gvr, status := range watcher.WatchedResources() {
+		resources = append(resources, &eventpb.WatchedResource{
+			Group:     gvr.Group,
+			Version:   gvr.Version,
+			Resource:  gvr.Resource,
+			State:     string(status.State),
+			Failures:  uint32(status.Failures),
+			LastError: status.LastError,
+		})
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		if resources[i].Group != resources[j].Group {
+			return resources[i].Group < resources[j].Group
+		}
+		return resources[i].Resource < resources[j].Resource
+	})
+	return resources
+}
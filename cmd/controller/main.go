@@ -15,11 +15,22 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/incidentassistant/k8s-agent/pkg/client"
+	"github.com/incidentassistant/k8s-agent/pkg/control"
+	"github.com/incidentassistant/k8s-agent/pkg/handler"
+	"github.com/incidentassistant/k8s-agent/pkg/health"
 	"github.com/incidentassistant/k8s-agent/pkg/watcher"
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
 
+	"k8s.io/apimachinery/pkg/util/uuid"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -53,8 +64,124 @@ func main() {
 
 	discoveryClient := clientset.Discovery()
 
+	// Report discovery problems and readiness on the health endpoints
+	health.Register("discovery", func() health.Status {
+		failed := watcher.FailedDiscoveryGroups()
+		return health.Status{Degraded: len(failed) > 0, Details: failed}
+	})
+	health.Register("resources", func() health.Status {
+		failing := watcher.FailingResources()
+		return health.Status{Degraded: len(failing) > 0, Details: failing}
+	})
+	health.SetReadiness(watcher.IsReady)
+
+	healthAddr := os.Getenv("HEALTH_ADDR")
+	if healthAddr == "" {
+		healthAddr = ":8080"
+	}
+	go health.ListenAndServe(healthAddr)
+
+	// Share a single connection to the central hub for every event
+	grpcSink, err := client.NewGRPCSink()
+	if err != nil {
+		log.Fatalf("Error creating event sink: %v", err)
+	}
+	var capabilities []string
+
+	// Stream events to the hub in batches, falling back to EmitEvent for older hubs
+	batchConfig := client.BatchConfigFromEnv()
+	if batchConfig.Enabled {
+		capabilities = append(capabilities, "stream-events")
+	}
+	var deliverySink client.EventSink = client.NewBatchingSink(grpcSink.Conn(), grpcSink, batchConfig)
+
+	// Keep events on disk as soon as the hub is unreachable and let the spool retry them,
+	// or, without a spool, retry transient failures in place
+	if spoolConfig, enabled := client.SpoolConfigFromEnv(); enabled {
+		spool, err := client.OpenSpool(spoolConfig)
+		if err != nil {
+			log.Fatalf("Error opening spool: %v", err)
+		}
+		spoolingSink := client.NewSpoolingSink(deliverySink, spool)
+		expvar.Publish("spool", expvar.Func(func() interface{} { return spoolingSink.Stats() }))
+		health.Register("spool", func() health.Status {
+			stats := spoolingSink.Stats()
+			return health.Status{Degraded: stats.Depth > 0, Details: stats}
+		})
+		deliverySink = spoolingSink
+		capabilities = append(capabilities, "spool")
+	} else {
+		deliverySink = client.NewRetryingSink(deliverySink, client.RetryConfigFromEnv())
+	}
+
+	// Number and sign events as they are delivered, so that the sequence follows the order
+	// in which the hub receives them
+	agentID := string(uuid.NewUUID())
+	signingConfig := client.SigningConfigFromEnv()
+	signingSink, err := client.NewSigningSink(deliverySink, agentID, signingConfig)
+	if err != nil {
+		log.Fatalf("Error setting up event signing: %v", err)
+	}
+	if signingConfig.Algorithm != "" {
+		capabilities = append(capabilities, "signing")
+	}
+
+	// Send from a bounded queue so a slow hub does not stall the watches, handing the
+	// queued events over in batches
+	queueConfig := client.QueueConfigFromEnv()
+	if batchConfig.Enabled {
+		queueConfig.BatchSize, queueConfig.BatchDelay = batchConfig.MaxSize, batchConfig.MaxDelay
+	}
+	sink := client.NewQueue(signingSink, queueConfig)
+	expvar.Publish("queue", expvar.Func(func() interface{} { return sink.Stats() }))
+
+	// Encrypt the payload of events before they are queued and spooled
+	var eventSink client.EventSink = sink
+	if encryptionConfig, enabled := client.EncryptionConfigFromEnv(); enabled {
+		encryptingSink, err := client.NewEncryptingSink(eventSink, encryptionConfig)
+		switch {
+		case errors.Is(err, client.ErrNoEncryptionKey):
+			// Deployments made before the key secret existed keep running rather than crash
+			log.Printf("WARNING: %s encryption is enabled but %v; events are sent WITHOUT payload encryption until the key secret is created and the agent restarted", encryptionConfig.Algorithm, err)
+		case err != nil:
+			log.Fatalf("Error setting up event encryption: %v", err)
+		default:
+			eventSink = encryptingSink
+			capabilities = append(capabilities, "encryption")
+		}
+	}
+	handler.SetSink(eventSink)
+
+	// Identify the cluster in every event and in the agent's registration
+	cluster := clusterID(clientset)
+	handler.SetClusterID(cluster)
+
 	watcher.StartWatching(dynamicClient, discoveryClient)
 
-	// Keep the main goroutine running
-	select {}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Let the hub send commands to the agent over the same connection
+	if os.Getenv("CONTROL_STREAM_ENABLED") != "false" {
+		capabilities = append(capabilities, "control")
+		go control.Run(ctx, grpcSink.Conn(), control.NewExecutor(dynamicClient))
+	}
+
+	// Announce the agent to the hub and keep reporting its status
+	heartbeater := client.NewHeartbeater(grpcSink.Conn(), agentInfo(clientset, agentID, cluster, capabilities), func() *eventpb.AgentStatus {
+		return &eventpb.AgentStatus{
+			Synced:     watcher.HasSynced(),
+			Resources:  watchedResources(),
+			QueueDepth: uint64(sink.Stats().Depth),
+		}
+	}, client.HeartbeatConfigFromEnv())
+	go heartbeater.Run(ctx)
+
+	// Keep running until the pod is asked to stop, then release the hub connection
+	<-ctx.Done()
+
+	log.Printf("Shutting down")
+	if err := eventSink.Close(); err != nil {
+		log.Printf("Error closing event sink: %v", err)
+	}
 }
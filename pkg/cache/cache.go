@@ -15,6 +15,8 @@
 package cache
 
 import (
+	"sort"
+	"strings"
 	"sync"
 
 	"k8s.io/apimachinery/pkg/runtime"
@@ -49,3 +51,37 @@ func (c *ObjectCache) Delete(key string) {
 	defer c.mu.Unlock()
 	delete(c.objects, key)
 }
+
+// DeleteFunc deletes the objects for which match returns true and returns how many it deleted.
+func (c *ObjectCache) DeleteFunc(match func(key string, obj runtime.Object) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deleted := 0
+	for key, obj := range c.objects {
+		if match(key, obj) {
+			delete(c.objects, key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// List returns the objects whose key starts with prefix, ordered by key.
+func (c *ObjectCache) List(prefix string) []runtime.Object {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	keys := make([]string, 0)
+	for key := range c.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	objects := make([]runtime.Object, 0, len(keys))
+	for _, key := range keys {
+		objects = append(objects, c.objects[key])
+	}
+	return objects
+}
@@ -15,8 +15,11 @@
 package cache
 
 import (
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"strings"
 	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 func TestObjectCache_SetGetDelete(t *testing.T) {
@@ -71,3 +74,40 @@ func TestObjectCache_Concurrency(t *testing.T) {
 		<-done
 	}
 }
+
+func TestObjectCache_List(t *testing.T) {
+	c := NewObjectCache()
+	for _, key := range []string{"default/pods/b", "default/pods/a", "kube-system/pods/c", "nodes/d"} {
+		obj := &unstructured.Unstructured{}
+		obj.SetName(key)
+		c.Set(key, obj)
+	}
+
+	objects := c.List("default/")
+	if len(objects) != 2 {
+		t.Fatalf("Expected 2 objects in the default namespace, got %d", len(objects))
+	}
+	if name := objects[0].(*unstructured.Unstructured).GetName(); name != "default/pods/a" {
+		t.Errorf("Expected objects ordered by key, got %s first", name)
+	}
+}
+
+func TestObjectCache_DeleteFunc(t *testing.T) {
+	c := NewObjectCache()
+	for _, key := range []string{"default/pods/a", "default/services/a", "nodes/b"} {
+		c.Set(key, &unstructured.Unstructured{})
+	}
+
+	deleted := c.DeleteFunc(func(key string, obj runtime.Object) bool {
+		return strings.Contains(key, "/pods/")
+	})
+	if deleted != 1 {
+		t.Errorf("Expected 1 object to be deleted, got %d", deleted)
+	}
+	if _, exists := c.Get("default/pods/a"); exists {
+		t.Errorf("Expected the pod to be deleted")
+	}
+	if len(c.List("")) != 2 {
+		t.Errorf("Expected the other objects to be kept, got %d", len(c.List("")))
+	}
+}
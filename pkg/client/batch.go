@@ -0,0 +1,211 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+// BatchConfig configures the batching of events.
+type BatchConfig struct {
+	// Enabled turns batching over StreamEvents on; when off every event goes to the fallback sink.
+	Enabled bool
+	// MaxSize is the largest batch the queue hands to the sink at once.
+	MaxSize int
+	// MaxDelay is how long the first event of a batch waits for the batch to fill up.
+	MaxDelay time.Duration
+	// AckTimeout bounds the wait for the hub to acknowledge a batch.
+	AckTimeout time.Duration
+}
+
+// BatchConfigFromEnv reads the batching configuration from STREAM_EVENTS_ENABLED,
+// BATCH_MAX_SIZE and BATCH_MAX_DELAY, falling back to defaults for unset or invalid values.
+func BatchConfigFromEnv() BatchConfig {
+	config := BatchConfig{
+		Enabled:    os.Getenv("STREAM_EVENTS_ENABLED") != "false",
+		MaxSize:    100,
+		MaxDelay:   time.Second,
+		AckTimeout: 10 * time.Second,
+	}
+	if size, err := strconv.Atoi(os.Getenv("BATCH_MAX_SIZE")); err == nil && size > 0 {
+		config.MaxSize = size
+	}
+	if delay, err := time.ParseDuration(os.Getenv("BATCH_MAX_DELAY")); err == nil && delay > 0 {
+		config.MaxDelay = delay
+	}
+	return config
+}
+
+// BatchingSink is a BatchSink that sends batches over the StreamEvents stream and waits for
+// the hub to acknowledge them, so that failures reach the sinks in front of it and are retried
+// or spooled there. If the hub does not implement StreamEvents, or batching is disabled, events
+// are sent one by one through the fallback sink, which sends them with EmitEvent.
+type BatchingSink struct {
+	client   eventpb.EventServiceClient
+	fallback EventSink
+	config   BatchConfig
+
+	// mu guards the stream; batches are sent one at a time so they arrive in order
+	mu           sync.Mutex
+	stream       eventpb.EventService_StreamEventsClient
+	cancelStream context.CancelFunc
+	nextBatchID  uint64
+	streaming    bool
+}
+
+// NewBatchingSink creates a batching sink sending over conn.
+func NewBatchingSink(conn *grpc.ClientConn, fallback EventSink, config BatchConfig) *BatchingSink {
+	return &BatchingSink{
+		client:    eventpb.NewEventServiceClient(conn),
+		fallback:  fallback,
+		config:    config,
+		streaming: config.Enabled,
+	}
+}
+
+// Send delivers a single event as a batch of its own.
+func (s *BatchingSink) Send(ctx context.Context, eventMessage *eventpb.EventMessage) error {
+	_, err := s.SendBatch(ctx, []*eventpb.EventMessage{eventMessage})
+	return err
+}
+
+// SendBatch delivers the events over the stream, where a batch is acknowledged as a whole,
+// or through the fallback sink if the hub does not support streaming.
+func (s *BatchingSink) SendBatch(ctx context.Context, batch []*eventpb.EventMessage) (int, error) {
+	if streamed, err := s.streamBatch(ctx, batch); streamed {
+		if err != nil {
+			return 0, err
+		}
+		return len(batch), nil
+	}
+
+	// The fallback sends every event on its own, so workers do not wait for each other
+	return sendBatch(ctx, s.fallback, batch)
+}
+
+// streamBatch sends a batch over the stream and reports whether it did, i.e. whether streaming
+// is on and supported by the hub.
+func (s *BatchingSink) streamBatch(ctx context.Context, batch []*eventpb.EventMessage) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.streaming {
+		return false, nil
+	}
+
+	err := s.sendBatch(ctx, batch)
+	if err == nil {
+		return true, nil
+	}
+	s.closeStream()
+	if status.Code(err) != codes.Unimplemented {
+		return true, err
+	}
+	log.Printf("Hub does not support StreamEvents, falling back to EmitEvent")
+	s.streaming = false
+	return false, nil
+}
+
+// sendBatch sends a batch over the stream, opening it if needed, and waits for its acknowledgement.
+func (s *BatchingSink) sendBatch(ctx context.Context, batch []*eventpb.EventMessage) error {
+	if s.stream == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := s.client.StreamEvents(ctx)
+		if err != nil {
+			cancel()
+			return err
+		}
+		s.stream, s.cancelStream = stream, cancel
+	}
+
+	s.nextBatchID++
+	batchID := s.nextBatchID
+	if err := s.stream.Send(&eventpb.EventBatch{BatchId: batchID, Events: batch}); err != nil {
+		// The actual error is only reported by Recv
+		_, recvErr := s.stream.Recv()
+		if recvErr != nil {
+			return streamError(recvErr)
+		}
+		return streamError(err)
+	}
+
+	type result struct {
+		ack *eventpb.BatchAck
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		ack, err := s.stream.Recv()
+		results <- result{ack, err}
+	}()
+
+	timer := time.NewTimer(s.config.AckTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		if r.err != nil {
+			return streamError(r.err)
+		}
+		if r.ack.BatchId != batchID || !r.ack.Acknowledged {
+			return fmt.Errorf("batch %d was not acknowledged", batchID)
+		}
+		return nil
+	case <-timer.C:
+		// Closing the stream unblocks the pending Recv
+		s.closeStream()
+		return status.Errorf(codes.DeadlineExceeded, "batch %d was not acknowledged within %s", batchID, s.config.AckTimeout)
+	case <-ctx.Done():
+		s.closeStream()
+		return ctx.Err()
+	}
+}
+
+// streamError returns the error of the stream as seen by the sinks in front: a stream the hub
+// ended, e.g. when it shuts down, is unavailable, so that the batch is retried on a new one.
+func streamError(err error) error {
+	if err == io.EOF {
+		return status.Error(codes.Unavailable, "hub closed the event stream")
+	}
+	return err
+}
+
+func (s *BatchingSink) closeStream() {
+	if s.stream == nil {
+		return
+	}
+	_ = s.stream.CloseSend()
+	s.cancelStream()
+	s.stream, s.cancelStream = nil, nil
+}
+
+// Close closes the stream and the fallback sink.
+func (s *BatchingSink) Close() error {
+	s.mu.Lock()
+	s.closeStream()
+	s.mu.Unlock()
+	return s.fallback.Close()
+}
@@ -0,0 +1,187 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+// streamingServer acknowledges every batch and records the batch sizes.
+type streamingServer struct {
+	eventpb.UnimplementedEventServiceServer
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (s *streamingServer) StreamEvents(stream eventpb.EventService_StreamEventsServer) error {
+	for {
+		batch, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.sizes = append(s.sizes, len(batch.Events))
+		s.mu.Unlock()
+		if err := stream.Send(&eventpb.BatchAck{BatchId: batch.BatchId, Acknowledged: true}); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *streamingServer) batchSizes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.sizes...)
+}
+
+// dialServer starts srv on an in-memory listener and returns a connection to it.
+func dialServer(t *testing.T, srv eventpb.EventServiceServer) *grpc.ClientConn {
+	t.Helper()
+	listener := bufconn.Listen(bufSize)
+	s := grpc.NewServer()
+	eventpb.RegisterEventServiceServer(s, srv)
+	go func() { _ = s.Serve(listener) }()
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial bufnet: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestBatchingSinkStreams(t *testing.T) {
+	srv := &streamingServer{}
+	fallback := &recordingSink{}
+	sink := NewBatchingSink(dialServer(t, srv), fallback, BatchConfig{Enabled: true, AckTimeout: time.Second})
+	defer sink.Close()
+
+	for _, keys := range [][]string{{"a", "b"}, {"c", "d"}, {"e"}} {
+		var batch []*eventpb.EventMessage
+		for _, key := range keys {
+			batch = append(batch, &eventpb.EventMessage{ResourceKey: key})
+		}
+		if n, err := sink.SendBatch(context.Background(), batch); n != len(batch) || err != nil {
+			t.Fatalf("Expected the batch to be delivered, got %d and %v", n, err)
+		}
+	}
+
+	if got := fmt.Sprint(srv.batchSizes()); got != "[2 2 1]" || len(fallback.keys()) != 0 {
+		t.Fatalf("Expected all events to be streamed, got batches %s and fallback %v", got, fallback.keys())
+	}
+}
+
+// unavailableServer fails every stream as if the hub were restarting.
+type unavailableServer struct {
+	eventpb.UnimplementedEventServiceServer
+}
+
+func (s *unavailableServer) StreamEvents(stream eventpb.EventService_StreamEventsServer) error {
+	return status.Error(codes.Unavailable, "hub restarting")
+}
+
+func TestBatchingSinkReportsFailures(t *testing.T) {
+	fallback := &recordingSink{}
+	sink := NewBatchingSink(dialServer(t, &unavailableServer{}), fallback, BatchConfig{Enabled: true, AckTimeout: time.Second})
+	defer sink.Close()
+
+	// The failure goes back to the caller, which retries or spools the events
+	n, err := sink.SendBatch(context.Background(), []*eventpb.EventMessage{{ResourceKey: "a"}, {ResourceKey: "b"}})
+	if n != 0 || status.Code(err) != codes.Unavailable {
+		t.Fatalf("Expected the batch to fail with Unavailable, got %d and %v", n, err)
+	}
+	if len(fallback.keys()) != 0 || !sink.streaming {
+		t.Fatalf("Expected the events not to go through the fallback sink, got %v", fallback.keys())
+	}
+}
+
+// closingServer acknowledges the first batch of every stream and then ends the stream, as a
+// hub does when it shuts down gracefully.
+type closingServer struct {
+	streamingServer
+}
+
+func (s *closingServer) StreamEvents(stream eventpb.EventService_StreamEventsServer) error {
+	batch, err := stream.Recv()
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	s.sizes = append(s.sizes, len(batch.Events))
+	s.mu.Unlock()
+	return stream.Send(&eventpb.BatchAck{BatchId: batch.BatchId, Acknowledged: true})
+}
+
+func TestBatchingSinkStreamEnded(t *testing.T) {
+	srv := &closingServer{}
+	sink := NewBatchingSink(dialServer(t, srv), &recordingSink{}, BatchConfig{Enabled: true, AckTimeout: time.Second})
+	defer sink.Close()
+
+	if n, err := sink.SendBatch(context.Background(), []*eventpb.EventMessage{{ResourceKey: "a"}}); n != 1 || err != nil {
+		t.Fatalf("Expected the first batch to be delivered, got %d and %v", n, err)
+	}
+
+	// The batch sent on the ended stream is retried rather than dropped
+	n, err := sink.SendBatch(context.Background(), []*eventpb.EventMessage{{ResourceKey: "b"}})
+	if n != 0 || status.Code(err) != codes.Unavailable || !isRetryable(err) {
+		t.Fatalf("Expected the batch to fail with Unavailable, got %d and %v", n, err)
+	}
+	if n, err := sink.SendBatch(context.Background(), []*eventpb.EventMessage{{ResourceKey: "b"}}); n != 1 || err != nil {
+		t.Fatalf("Expected the batch to be delivered on a new stream, got %d and %v", n, err)
+	}
+	if got := fmt.Sprint(srv.batchSizes()); got != "[1 1]" {
+		t.Fatalf("Expected two delivered batches, got %s", got)
+	}
+}
+
+func TestBatchingSinkFallsBackToEmitEvent(t *testing.T) {
+	// The hub only implements the unary EmitEvent
+	fallback := &recordingSink{}
+	sink := NewBatchingSink(dialServer(t, &server{}), fallback, BatchConfig{Enabled: true, AckTimeout: time.Second})
+
+	for _, key := range []string{"a", "b"} {
+		if err := sink.Send(context.Background(), &eventpb.EventMessage{ResourceKey: key}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	_ = sink.Close()
+
+	if len(fallback.keys()) != 2 || fallback.keys()[0] != "a" || fallback.keys()[1] != "b" {
+		t.Fatalf("Expected events to go through the fallback sink, got %v", fallback.keys())
+	}
+	if sink.streaming {
+		t.Fatal("Expected streaming to be turned off after Unimplemented")
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strconv"
+	"unicode/utf16"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+// canonicalEvent returns the canonical form of an event covered by its signature, so that a
+// hub in any language, and with any version of event.proto, can rebuild the signed bytes from
+// the fields it received. It is a JSON object with a member for every field of EventMessage
+// but signature and the deprecated apiKey, named as in event.proto and serialized with the
+// JSON Canonicalization Scheme of RFC 8785, i.e. with sorted keys and no whitespace. Fields
+// at their default value are included. Strings and booleans are written as such, bytes as
+// padded standard base64, 64-bit integers as decimal strings, enums by name, maps as objects,
+// repeated fields as arrays, unset messages as null and observedAt as {seconds, nanos}.
+func canonicalEvent(eventMessage *eventpb.EventMessage) []byte {
+	ownerReferences := make([]interface{}, 0, len(eventMessage.OwnerReferences))
+	for _, ref := range eventMessage.OwnerReferences {
+		ownerReferences = append(ownerReferences, map[string]interface{}{
+			"apiVersion": ref.ApiVersion,
+			"kind":       ref.Kind,
+			"name":       ref.Name,
+			"uid":        ref.Uid,
+			"controller": ref.Controller,
+		})
+	}
+	changes := make([]interface{}, 0, len(eventMessage.Changes))
+	for _, change := range eventMessage.Changes {
+		changes = append(changes, map[string]interface{}{
+			"path":     change.Path,
+			"old":      change.Old,
+			"new":      change.New,
+			"op":       change.Op.String(),
+			"from":     change.From,
+			"identity": change.Identity,
+		})
+	}
+	var observedAt, encryption interface{}
+	if ts := eventMessage.ObservedAt; ts != nil {
+		observedAt = map[string]interface{}{
+			"seconds": strconv.FormatInt(ts.Seconds, 10),
+			"nanos":   int64(ts.Nanos),
+		}
+	}
+	if e := eventMessage.Encryption; e != nil {
+		encryption = map[string]interface{}{
+			"algorithm": e.Algorithm,
+			"keyId":     e.KeyId,
+			"nonce":     e.Nonce,
+		}
+	}
+
+	var buf bytes.Buffer
+	writeCanonical(&buf, map[string]interface{}{
+		"namespace":       eventMessage.Namespace,
+		"resourceKey":     eventMessage.ResourceKey,
+		"eventType":       eventMessage.EventType,
+		"data":            eventMessage.Data,
+		"clusterId":       eventMessage.ClusterId,
+		"group":           eventMessage.Group,
+		"version":         eventMessage.Version,
+		"kind":            eventMessage.Kind,
+		"resource":        eventMessage.Resource,
+		"name":            eventMessage.Name,
+		"uid":             eventMessage.Uid,
+		"resourceVersion": eventMessage.ResourceVersion,
+		"generation":      strconv.FormatInt(eventMessage.Generation, 10),
+		"observedAt":      observedAt,
+		"labels":          stringMap(eventMessage.Labels),
+		"ownerReferences": ownerReferences,
+		"changes":         changes,
+		"encryption":      encryption,
+		"agentId":         eventMessage.AgentId,
+		"sequence":        strconv.FormatUint(eventMessage.Sequence, 10),
+		"category":        eventMessage.Category,
+		"tags":            stringMap(eventMessage.Tags),
+	})
+	return buf.Bytes()
+}
+
+func stringMap(m map[string]string) map[string]interface{} {
+	values := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		values[k] = v
+	}
+	return values
+}
+
+// writeCanonical writes a value as RFC 8785 canonical JSON. Integers are the only numbers.
+func writeCanonical(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case int64:
+		buf.WriteString(strconv.FormatInt(v, 10))
+	case string:
+		writeCanonicalString(buf, v)
+	case []byte:
+		writeCanonicalString(buf, base64.StdEncoding.EncodeToString(v))
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, element := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonical(buf, element)
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		// Keys are sorted by their UTF-16 code units
+		slices.SortFunc(keys, func(a, b string) int {
+			return slices.Compare(utf16.Encode([]rune(a)), utf16.Encode([]rune(b)))
+		})
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, k)
+			buf.WriteByte(':')
+			writeCanonical(buf, v[k])
+		}
+		buf.WriteByte('}')
+	default:
+		panic(fmt.Sprintf("no canonical form for %T", value))
+	}
+}
+
+// writeCanonicalString writes a string, escaping only quotes, backslashes and control characters.
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(buf, `\u%04x`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
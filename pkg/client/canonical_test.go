@@ -0,0 +1,62 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+func TestCanonicalEvent(t *testing.T) {
+	// The example of the README
+	eventMessage := &eventpb.EventMessage{
+		Namespace: "default", ResourceKey: "web", EventType: "ADDED", Data: []byte("{}"), ClusterId: "c1",
+		Group: "apps", Version: "v1", Kind: "Deployment", Resource: "deployments", Name: "web", Uid: "u1",
+		ResourceVersion: "42", Generation: 1, ObservedAt: &timestamppb.Timestamp{Seconds: 1700000000, Nanos: 5},
+		AgentId: "a1", Sequence: 7,
+		Signature: &eventpb.Signature{Algorithm: AlgorithmHMACSHA256, Value: []byte("ignored")},
+	}
+	expected := `{"agentId":"a1","category":"","changes":[],"clusterId":"c1","data":"e30=","encryption":null,` +
+		`"eventType":"ADDED","generation":"1","group":"apps","kind":"Deployment","labels":{},"name":"web",` +
+		`"namespace":"default","observedAt":{"nanos":5,"seconds":"1700000000"},"ownerReferences":[],` +
+		`"resource":"deployments","resourceKey":"web","resourceVersion":"42","sequence":"7","tags":{},"uid":"u1","version":"v1"}`
+	if got := string(canonicalEvent(eventMessage)); got != expected {
+		t.Fatalf("Unexpected canonical form:\n%s\nexpected:\n%s", got, expected)
+	}
+
+	// Nested messages and escaping
+	eventMessage = &eventpb.EventMessage{
+		Labels:          map[string]string{"b": "1", "a": "x\"\\\n\u0001</> é"},
+		OwnerReferences: []*eventpb.OwnerReference{{Kind: "ReplicaSet", Controller: true}},
+		Changes:         []*eventpb.FieldChange{{Path: "/spec/replicas", Op: eventpb.FieldChange_OP_REPLACE, Old: []byte("1"), New: []byte("2")}},
+		Encryption:      &eventpb.Encryption{Algorithm: AlgorithmAESGCM, KeyId: "k1", Nonce: []byte{0xff}},
+	}
+	data := canonicalEvent(eventMessage)
+	for _, part := range []string{
+		`"labels":{"a":"x\"\\\n\u0001</>` + " é" + `","b":"1"}`,
+		`"ownerReferences":[{"apiVersion":"","controller":true,"kind":"ReplicaSet","name":"","uid":""}]`,
+		`"changes":[{"from":"","identity":"","new":"Mg==","old":"MQ==","op":"OP_REPLACE","path":"/spec/replicas"}]`,
+		`"encryption":{"algorithm":"AES-GCM","keyId":"k1","nonce":"/w=="}`,
+		`"observedAt":null`,
+	} {
+		if !bytes.Contains(data, []byte(part)) {
+			t.Errorf("Expected %s in %s", part, data)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// apiKeyCredentials attaches the API key to every RPC as a bearer token in the
+// authorization metadata, so that it is never part of the event payload.
+type apiKeyCredentials struct {
+	key        func() (string, error)
+	requireTLS bool
+}
+
+var _ credentials.PerRPCCredentials = apiKeyCredentials{}
+
+// GetRequestMetadata returns the authorization header for an RPC.
+func (c apiKeyCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	key, err := c.key()
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, nil
+	}
+	return map[string]string{"authorization": "Bearer " + key}, nil
+}
+
+// RequireTransportSecurity reports whether the key may only be sent over TLS.
+func (c apiKeyCredentials) RequireTransportSecurity() bool {
+	return c.requireTLS
+}
+
+// apiKeyFromEnv returns the source of the API key: the file named by API_KEY_FILE,
+// re-read whenever it changes, or else the value of API_KEY. It returns nil if neither is set.
+func apiKeyFromEnv() func() (string, error) {
+	if path := os.Getenv("API_KEY_FILE"); path != "" {
+		return (&fileKey{path: path}).read
+	}
+	if key := os.Getenv("API_KEY"); key != "" {
+		return func() (string, error) { return key, nil }
+	}
+	return nil
+}
+
+// fileKey reads a key, such as the API key or the encryption key, from a file, typically a
+// mounted secret, and reads it again whenever the file changes so that a rotated key is used
+// without a restart.
+type fileKey struct {
+	path string
+
+	mu      sync.Mutex
+	key     string
+	modTime time.Time
+	size    int64
+}
+
+func (f *fileKey) read() (string, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", fmt.Errorf("could not read key: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.key != "" && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.key, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return "", fmt.Errorf("could not read key: %w", err)
+	}
+	f.key = strings.TrimSpace(string(data))
+	f.modTime, f.size = info.ModTime(), info.Size()
+	return f.key, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+// authServer records the authorization metadata of every event.
+type authServer struct {
+	eventpb.UnimplementedEventServiceServer
+	mu     sync.Mutex
+	tokens []string
+}
+
+func (s *authServer) EmitEvent(ctx context.Context, message *eventpb.EventMessage) (*eventpb.EventResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = append(s.tokens, md.Get("authorization")...)
+	return &eventpb.EventResponse{Acknowledged: true}, nil
+}
+
+// writeKey writes a key file with a distinct modification time, like a rotated secret.
+func writeKey(t *testing.T, path, key string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(key+"\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Failed to set key modification time: %v", err)
+	}
+}
+
+func TestAPIKeyCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api-key")
+	now := time.Now()
+	writeKey(t, path, "first", now)
+	t.Setenv("API_KEY_FILE", path)
+	t.Setenv("API_KEY", "ignored")
+
+	srv := &authServer{}
+	listener := bufconn.Listen(bufSize)
+	s := grpc.NewServer()
+	eventpb.RegisterEventServiceServer(s, srv)
+	go func() { _ = s.Serve(listener) }()
+	defer s.Stop()
+
+	sink, err := newGRPCSink("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(apiKeyCredentials{key: apiKeyFromEnv()}))
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+	defer sink.Close()
+
+	if err := sink.Send(context.Background(), &eventpb.EventMessage{Name: "a"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	// A rotated key is picked up without recreating the connection
+	writeKey(t, path, "second", now.Add(time.Minute))
+	if err := sink.Send(context.Background(), &eventpb.EventMessage{Name: "b"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.tokens) != 2 || srv.tokens[0] != "Bearer first" || srv.tokens[1] != "Bearer second" {
+		t.Fatalf("Expected the first and then the rotated key, got %v", srv.tokens)
+	}
+}
+
+func TestAPIKeyFromEnv(t *testing.T) {
+	t.Setenv("API_KEY_FILE", "")
+	t.Setenv("API_KEY", "")
+	if apiKeyFromEnv() != nil {
+		t.Fatal("Expected no credentials without a key")
+	}
+
+	t.Setenv("API_KEY", "secret")
+	md, err := apiKeyCredentials{key: apiKeyFromEnv()}.GetRequestMetadata(context.Background())
+	if err != nil || md["authorization"] != "Bearer secret" {
+		t.Fatalf("Expected the key from API_KEY, got %v, %v", md, err)
+	}
+
+	t.Setenv("API_KEY_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, err := (apiKeyCredentials{key: apiKeyFromEnv()}).GetRequestMetadata(context.Background()); err == nil {
+		t.Fatal("Expected an error for a missing key file")
+	}
+}
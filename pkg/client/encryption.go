@@ -0,0 +1,211 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+// AlgorithmAESGCM is the only supported payload encryption algorithm.
+const AlgorithmAESGCM = "AES-GCM"
+
+// ErrNoEncryptionKey is returned when encryption is enabled but there is no key to encrypt
+// with, e.g. because the key secret was not created.
+var ErrNoEncryptionKey = errors.New("no encryption key")
+
+// EncryptionConfig configures the encryption of event payloads.
+type EncryptionConfig struct {
+	// Algorithm is the encryption algorithm; only AES-GCM is supported.
+	Algorithm string
+	// KeyFile holds the base64-encoded 128, 192 or 256-bit key, typically from a mounted secret.
+	KeyFile string
+}
+
+// EncryptionConfigFromEnv reads the encryption configuration from ENCRYPTION_ALGORITHM and
+// ENCRYPTION_KEY_FILE, and reports whether encryption is enabled.
+func EncryptionConfigFromEnv() (EncryptionConfig, bool) {
+	config := EncryptionConfig{
+		Algorithm: os.Getenv("ENCRYPTION_ALGORITHM"),
+		KeyFile:   os.Getenv("ENCRYPTION_KEY_FILE"),
+	}
+	return config, config.Algorithm != "" && config.Algorithm != "none"
+}
+
+// EncryptingSink is an EventSink that encrypts the data and changes of every event with
+// AES-GCM before passing it on, so that they stay confidential in the spool and at the hub's
+// transport endpoint. Each event carries the ID of its key and its nonce. The key file is read
+// again when it changes; the hub keeps the previous keys to decrypt events sent before a rotation.
+type EncryptingSink struct {
+	sink EventSink
+	key  func() (string, error)
+
+	// mu guards the cipher of the current key
+	mu      sync.Mutex
+	encoded string
+	keyID   string
+	aead    cipher.AEAD
+}
+
+// NewEncryptingSink creates a sink encrypting events for sink. It fails if the algorithm
+// is not supported or the key cannot be loaded, with ErrNoEncryptionKey if there is no key file.
+func NewEncryptingSink(sink EventSink, config EncryptionConfig) (*EncryptingSink, error) {
+	if config.Algorithm != AlgorithmAESGCM {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", config.Algorithm)
+	}
+	if config.KeyFile == "" {
+		return nil, fmt.Errorf("%w: ENCRYPTION_KEY_FILE is not set", ErrNoEncryptionKey)
+	}
+	if _, err := os.Stat(config.KeyFile); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s does not exist", ErrNoEncryptionKey, config.KeyFile)
+	}
+
+	s := &EncryptingSink{
+		sink: sink,
+		key:  (&fileKey{path: config.KeyFile}).read,
+	}
+	if _, _, err := s.cipher(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// cipher returns the cipher and ID of the current key.
+func (s *EncryptingSink) cipher() (cipher.AEAD, string, error) {
+	encoded, err := s.key()
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aead != nil && encoded == s.encoded {
+		return s.aead, s.keyID, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not decode encryption key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.encoded, s.keyID, s.aead = encoded, keyID(key), aead
+	return s.aead, s.keyID, nil
+}
+
+// keyID identifies a key without revealing it.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Send encrypts the event and passes it on. The event itself is left unchanged.
+func (s *EncryptingSink) Send(ctx context.Context, eventMessage *eventpb.EventMessage) error {
+	encrypted, err := s.encrypt(eventMessage)
+	if err != nil {
+		return err
+	}
+	return s.sink.Send(ctx, encrypted)
+}
+
+func (s *EncryptingSink) encrypt(eventMessage *eventpb.EventMessage) (*eventpb.EventMessage, error) {
+	aead, keyID, err := s.cipher()
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := proto.Marshal(&eventpb.EventPayload{Data: eventMessage.Data, Changes: eventMessage.Changes})
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	encrypted := proto.Clone(eventMessage).(*eventpb.EventMessage)
+	encrypted.Data = aead.Seal(nil, nonce, plaintext, nil)
+	encrypted.Changes = nil
+	encrypted.Encryption = &eventpb.Encryption{
+		Algorithm: AlgorithmAESGCM,
+		KeyId:     keyID,
+		Nonce:     nonce,
+	}
+	return encrypted, nil
+}
+
+// Close closes the underlying sink.
+func (s *EncryptingSink) Close() error {
+	return s.sink.Close()
+}
+
+// DecryptPayload decrypts the payload of an encrypted event with the key matching its key ID,
+// as the hub does. keys maps key IDs to raw keys, so that events encrypted with a previous key
+// can still be decrypted after a rotation.
+func DecryptPayload(eventMessage *eventpb.EventMessage, keys map[string][]byte) (*eventpb.EventPayload, error) {
+	encryption := eventMessage.Encryption
+	if encryption == nil {
+		return &eventpb.EventPayload{Data: eventMessage.Data, Changes: eventMessage.Changes}, nil
+	}
+	if encryption.Algorithm != AlgorithmAESGCM {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", encryption.Algorithm)
+	}
+	key, ok := keys[encryption.KeyId]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %s", encryption.KeyId)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(encryption.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce of %d bytes", len(encryption.Nonce))
+	}
+	plaintext, err := aead.Open(nil, encryption.Nonce, eventMessage.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt event: %w", err)
+	}
+
+	payload := &eventpb.EventPayload{}
+	if err := proto.Unmarshal(plaintext, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+func TestEncryptingSink(t *testing.T) {
+	firstKey, secondKey := make([]byte, 32), make([]byte, 32)
+	for i := range firstKey {
+		firstKey[i], secondKey[i] = byte(i), byte(255-i)
+	}
+	path := filepath.Join(t.TempDir(), "key")
+	now := time.Now()
+	writeKey(t, path, base64.StdEncoding.EncodeToString(firstKey), now)
+
+	recorder := &recordingSink{}
+	sink, err := NewEncryptingSink(recorder, EncryptionConfig{Algorithm: AlgorithmAESGCM, KeyFile: path})
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+
+	original := &eventpb.EventMessage{
+		Name:    "web",
+		Data:    []byte(`{"/spec/replicas":{"old":3,"new":1}}`),
+		Changes: []*eventpb.FieldChange{{Path: "/spec/replicas", Old: []byte("3"), New: []byte("1")}},
+	}
+	if err := sink.Send(context.Background(), original); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	// Rotate the key; events sent from now on use the new one
+	writeKey(t, path, base64.StdEncoding.EncodeToString(secondKey), now.Add(time.Minute))
+	if err := sink.Send(context.Background(), original); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if string(original.Data) != `{"/spec/replicas":{"old":3,"new":1}}` || len(original.Changes) != 1 || original.Encryption != nil {
+		t.Fatal("Expected the original event to be left unchanged")
+	}
+
+	first, second := recorder.sent()[0], recorder.sent()[1]
+	if first.Name != "web" || len(first.Changes) != 0 || string(first.Data) == string(original.Data) {
+		t.Fatalf("Expected the data and changes to be encrypted, got %+v", first)
+	}
+	if first.Encryption.KeyId != keyID(firstKey) || second.Encryption.KeyId != keyID(secondKey) {
+		t.Fatalf("Expected the key ID to follow the rotation, got %s and %s", first.Encryption.KeyId, second.Encryption.KeyId)
+	}
+
+	// The hub keeps both keys and decrypts each event with the one it names
+	keys := map[string][]byte{keyID(firstKey): firstKey, keyID(secondKey): secondKey}
+	for _, encrypted := range recorder.sent() {
+		payload, err := DecryptPayload(encrypted, keys)
+		if err != nil {
+			t.Fatalf("Failed to decrypt event: %v", err)
+		}
+		if string(payload.Data) != string(original.Data) || len(payload.Changes) != 1 || payload.Changes[0].Path != "/spec/replicas" {
+			t.Fatalf("Unexpected decrypted payload: %+v", payload)
+		}
+	}
+
+	// Tampered ciphertext is rejected
+	second.Data[0] ^= 0xff
+	if _, err := DecryptPayload(second, keys); err == nil {
+		t.Fatal("Expected tampered data to fail decryption")
+	}
+}
+
+func TestNewEncryptingSinkErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	writeKey(t, path, base64.StdEncoding.EncodeToString([]byte("too short")), time.Now())
+
+	for name, config := range map[string]EncryptionConfig{
+		"unsupported algorithm": {Algorithm: "ROT13", KeyFile: path},
+		"invalid key":           {Algorithm: AlgorithmAESGCM, KeyFile: path},
+	} {
+		if _, err := NewEncryptingSink(&recordingSink{}, config); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// A missing key is told apart, so that the agent can run without encryption
+	for name, config := range map[string]EncryptionConfig{
+		"unset key file":   {Algorithm: AlgorithmAESGCM},
+		"missing key file": {Algorithm: AlgorithmAESGCM, KeyFile: filepath.Join(t.TempDir(), "missing")},
+	} {
+		if _, err := NewEncryptingSink(&recordingSink{}, config); !errors.Is(err, ErrNoEncryptionKey) {
+			t.Errorf("%s: expected ErrNoEncryptionKey, got %v", name, err)
+		}
+	}
+}
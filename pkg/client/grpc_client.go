@@ -17,45 +17,155 @@ package client
 import (
 	"context"
 	"fmt"
+	"log"
 	"os"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure" // Import the insecure package
+	"google.golang.org/grpc/keepalive"
 
 	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
 )
 
-// NewEventServiceClient creates a new client for the EventService
-func NewEventServiceClient() (eventpb.EventServiceClient, error) {
-	destinationURL := os.Getenv("DESTINATION_URL") // Central hub URL
-	useTLS := os.Getenv("USE_TLS") == "true"       // New environment variable to control TLS usage
+// EventSink delivers event messages to the central hub.
+type EventSink interface {
+	// Send delivers a single event message.
+	Send(ctx context.Context, eventMessage *eventpb.EventMessage) error
+	// Close flushes and releases the resources held by the sink.
+	Close() error
+}
+
+// BatchSink is an EventSink that can also deliver several events at once.
+type BatchSink interface {
+	EventSink
+	// SendBatch delivers the events in order and stops at the first failure. It returns
+	// the number of events delivered and the failure, if any.
+	SendBatch(ctx context.Context, batch []*eventpb.EventMessage) (int, error)
+}
+
+// sendBatch delivers the events to sink, one by one if it cannot take them at once.
+func sendBatch(ctx context.Context, sink EventSink, batch []*eventpb.EventMessage) (int, error) {
+	if batchSink, ok := sink.(BatchSink); ok {
+		return batchSink.SendBatch(ctx, batch)
+	}
+	for i, eventMessage := range batch {
+		if err := sink.Send(ctx, eventMessage); err != nil {
+			return i, err
+		}
+	}
+	return len(batch), nil
+}
+
+// GRPCSink sends events over a single long-lived gRPC connection to the central hub.
+// gRPC re-establishes the connection transparently after failures, and keepalive
+// pings detect a dead hub even while no events are being sent.
+type GRPCSink struct {
+	conn   *grpc.ClientConn
+	client eventpb.EventServiceClient
+}
+
+// NewGRPCSink creates a sink connected to the hub configured by DESTINATION_URL and the
+// TLS settings read by TLSConfigFromEnv, authenticated with the key from API_KEY_FILE or API_KEY.
+func NewGRPCSink() (*GRPCSink, error) {
+	opts, err := dialOptions()
+	if err != nil {
+		return nil, err
+	}
+	return newGRPCSink(os.Getenv("DESTINATION_URL"), opts...)
+}
+
+func newGRPCSink(target string, opts ...grpc.DialOption) (*GRPCSink, error) {
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to gRPC server: %w", err)
+	}
+
+	return &GRPCSink{
+		conn:   conn,
+		client: eventpb.NewEventServiceClient(conn),
+	}, nil
+}
+
+// Conn returns the underlying connection, for use by other hub RPCs.
+func (s *GRPCSink) Conn() *grpc.ClientConn {
+	return s.conn
+}
+
+// Send sends an event to the EventService.
+func (s *GRPCSink) Send(ctx context.Context, eventMessage *eventpb.EventMessage) error {
+	response, err := SendEvent(ctx, s.client, eventMessage)
+	if err != nil {
+		return err
+	}
+	if !response.Acknowledged {
+		return fmt.Errorf("event was not acknowledged")
+	}
+	return nil
+}
+
+// Close closes the connection to the hub.
+func (s *GRPCSink) Close() error {
+	return s.conn.Close()
+}
+
+// dialOptions returns the dial options for the hub connection.
+func dialOptions() ([]grpc.DialOption, error) {
+	tlsConfig, err := TLSConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
 
 	var opts []grpc.DialOption
-	if useTLS {
-		// Use the system's default CA certificates
-		creds := credentials.NewClientTLSFromCert(nil, "")
-		opts = append(opts, grpc.WithTransportCredentials(creds))
+	if tlsConfig.Enabled {
+		config, err := tlsConfig.clientConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(config)))
 	} else {
 		// Use insecure credentials
 		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials())) // Updated line
 	}
 
-	// Set up a connection to the server
-	conn, err := grpc.Dial(destinationURL, opts...)
-	if err != nil {
-		return nil, fmt.Errorf("could not connect to gRPC server: %w", err)
+	// Authenticate every RPC with the API key
+	if key := apiKeyFromEnv(); key != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(apiKeyCredentials{key: key, requireTLS: tlsConfig.Enabled}))
 	}
 
-	// Create a new EventService client
-	client := eventpb.NewEventServiceClient(conn)
-	return client, nil
+	// Ping the hub periodically so a dead connection is noticed and re-established
+	opts = append(opts, grpc.WithKeepaliveParams(keepaliveParamsFromEnv()))
+
+	return opts, nil
+}
+
+// defaultKeepaliveTime is the ping interval gRPC servers accept by default: their enforcement
+// policy answers more frequent pings with a GOAWAY, which drops the connection and its streams.
+const defaultKeepaliveTime = 5 * time.Minute
+
+// keepaliveParamsFromEnv reads the ping interval from GRPC_KEEPALIVE_TIME. Shorter intervals
+// require the hub to permit them with a keepalive.EnforcementPolicy whose MinTime is at most
+// the interval and which permits pings without streams.
+func keepaliveParamsFromEnv() keepalive.ClientParameters {
+	params := keepalive.ClientParameters{
+		Time:                defaultKeepaliveTime,
+		Timeout:             10 * time.Second,
+		PermitWithoutStream: true,
+	}
+	if value := os.Getenv("GRPC_KEEPALIVE_TIME"); value != "" {
+		if interval, err := time.ParseDuration(value); err == nil && interval > 0 {
+			params.Time = interval
+		} else {
+			log.Printf("Invalid GRPC_KEEPALIVE_TIME %q, using %s", value, params.Time)
+		}
+	}
+	return params
 }
 
 // SendEvent sends an event to the EventService
-func SendEvent(client eventpb.EventServiceClient, eventMessage *eventpb.EventMessage) (*eventpb.EventResponse, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func SendEvent(ctx context.Context, client eventpb.EventServiceClient, eventMessage *eventpb.EventMessage) (*eventpb.EventResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	response, err := client.EmitEvent(ctx, eventMessage)
@@ -17,10 +17,13 @@ package client
 import (
 	"context"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
 	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/test/bufconn"
 )
 
@@ -28,6 +31,39 @@ const bufSize = 1024 * 1024
 
 var lis *bufconn.Listener
 
+// recordingSink records the events sent to it.
+type recordingSink struct {
+	mu     sync.Mutex
+	events []*eventpb.EventMessage
+}
+
+func (s *recordingSink) Send(ctx context.Context, eventMessage *eventpb.EventMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, eventMessage)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+// sent returns the events recorded so far.
+func (s *recordingSink) sent() []*eventpb.EventMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*eventpb.EventMessage(nil), s.events...)
+}
+
+// keys returns the resource keys of the events recorded so far.
+func (s *recordingSink) keys() []string {
+	var keys []string
+	for _, eventMessage := range s.sent() {
+		keys = append(keys, eventMessage.ResourceKey)
+	}
+	return keys
+}
+
 type server struct {
 	eventpb.UnimplementedEventServiceServer
 }
@@ -69,3 +105,41 @@ func TestSendEvent(t *testing.T) {
 		t.Fatalf("EmitEvent response not acknowledged")
 	}
 }
+
+func TestGRPCSink(t *testing.T) {
+	sink, err := newGRPCSink("bufnet", grpc.WithContextDialer(bufDialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+
+	// Every event goes over the same connection
+	for i := 0; i < 3; i++ {
+		if err := sink.Send(context.Background(), &eventpb.EventMessage{ResourceKey: "test-pod"}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := sink.Send(context.Background(), &eventpb.EventMessage{}); err == nil {
+		t.Fatal("Expected Send to fail after Close")
+	}
+}
+
+func TestKeepaliveParamsFromEnv(t *testing.T) {
+	t.Setenv("GRPC_KEEPALIVE_TIME", "")
+	if params := keepaliveParamsFromEnv(); params.Time != 5*time.Minute || !params.PermitWithoutStream {
+		t.Fatalf("Expected pings every 5m by default, got %+v", params)
+	}
+
+	t.Setenv("GRPC_KEEPALIVE_TIME", "1m")
+	if params := keepaliveParamsFromEnv(); params.Time != time.Minute {
+		t.Fatalf("Expected pings every minute, got %+v", params)
+	}
+
+	t.Setenv("GRPC_KEEPALIVE_TIME", "often")
+	if params := keepaliveParamsFromEnv(); params.Time != 5*time.Minute {
+		t.Fatalf("Expected an invalid interval to be ignored, got %+v", params)
+	}
+}
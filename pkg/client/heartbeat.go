@@ -0,0 +1,143 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+// HeartbeatConfig configures the registration of the agent and its heartbeats.
+type HeartbeatConfig struct {
+	// Interval is the time between two heartbeats, unless the hub asks for another one.
+	Interval time.Duration
+	// Timeout bounds every RegisterAgent and Heartbeat call.
+	Timeout time.Duration
+}
+
+// HeartbeatConfigFromEnv reads the heartbeat interval from HEARTBEAT_INTERVAL,
+// falling back to 30s for unset or invalid values.
+func HeartbeatConfigFromEnv() HeartbeatConfig {
+	config := HeartbeatConfig{
+		Interval: 30 * time.Second,
+		Timeout:  5 * time.Second,
+	}
+	if interval, err := time.ParseDuration(os.Getenv("HEARTBEAT_INTERVAL")); err == nil && interval > 0 {
+		config.Interval = interval
+	}
+	return config
+}
+
+// Heartbeater registers the agent with the hub and then reports its status periodically.
+type Heartbeater struct {
+	client eventpb.EventServiceClient
+	info   *eventpb.AgentInfo
+	status func() *eventpb.AgentStatus
+	config HeartbeatConfig
+}
+
+// NewHeartbeater creates a heartbeater announcing info over conn. status is called for
+// every heartbeat; the agent ID and cluster ID are filled in from info.
+func NewHeartbeater(conn grpc.ClientConnInterface, info *eventpb.AgentInfo, status func() *eventpb.AgentStatus, config HeartbeatConfig) *Heartbeater {
+	return &Heartbeater{
+		client: eventpb.NewEventServiceClient(conn),
+		info:   info,
+		status: status,
+		config: config,
+	}
+}
+
+// Run registers the agent and sends heartbeats until ctx is cancelled. Registration is
+// retried every interval until it succeeds, and repeated whenever the hub asks for it.
+// If the hub does not implement these RPCs, Run returns.
+func (h *Heartbeater) Run(ctx context.Context) {
+	interval := h.config.Interval
+	registered := false
+	for {
+		var err error
+		if registered {
+			registered, err = h.heartbeat(ctx)
+			if !registered && err == nil {
+				// Register again right away
+				continue
+			}
+		} else {
+			var hubInterval time.Duration
+			registered, hubInterval, err = h.register(ctx)
+			if hubInterval > 0 {
+				interval = hubInterval
+			}
+		}
+		if status.Code(err) == codes.Unimplemented {
+			log.Printf("Hub does not support agent registration, heartbeats disabled")
+			return
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Error reporting agent status to the hub: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// register announces the agent and returns the heartbeat interval requested by the hub, if any.
+func (h *Heartbeater) register(ctx context.Context) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.config.Timeout)
+	defer cancel()
+
+	response, err := h.client.RegisterAgent(ctx, h.info)
+	if err != nil {
+		return false, 0, err
+	}
+	if !response.Acknowledged {
+		log.Printf("Hub did not acknowledge the registration of agent %s", h.info.AgentId)
+		return false, 0, nil
+	}
+	log.Printf("Registered agent %s with the hub", h.info.AgentId)
+	return true, time.Duration(response.HeartbeatIntervalSeconds) * time.Second, nil
+}
+
+// heartbeat reports the current status and returns whether the agent is still registered.
+func (h *Heartbeater) heartbeat(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.config.Timeout)
+	defer cancel()
+
+	agentStatus := h.status()
+	agentStatus.AgentId = h.info.AgentId
+	agentStatus.ClusterId = h.info.ClusterId
+
+	response, err := h.client.Heartbeat(ctx, agentStatus)
+	if err != nil {
+		// A failed heartbeat does not mean the hub forgot the agent
+		return true, err
+	}
+	if response.Reregister {
+		log.Printf("Hub asked agent %s to register again", h.info.AgentId)
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+// registryServer records registrations and heartbeats, and asks the agent to register
+// again on the heartbeat numbered forgetAt.
+type registryServer struct {
+	eventpb.UnimplementedEventServiceServer
+	forgetAt int
+
+	mu            sync.Mutex
+	registrations int
+	heartbeats    []*eventpb.AgentStatus
+}
+
+func (s *registryServer) RegisterAgent(ctx context.Context, info *eventpb.AgentInfo) (*eventpb.RegisterAgentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registrations++
+	return &eventpb.RegisterAgentResponse{Acknowledged: true}, nil
+}
+
+func (s *registryServer) Heartbeat(ctx context.Context, agentStatus *eventpb.AgentStatus) (*eventpb.HeartbeatResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.heartbeats = append(s.heartbeats, agentStatus)
+	return &eventpb.HeartbeatResponse{Acknowledged: true, Reregister: len(s.heartbeats) == s.forgetAt}, nil
+}
+
+func (s *registryServer) counts() (int, []*eventpb.AgentStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.registrations, append([]*eventpb.AgentStatus(nil), s.heartbeats...)
+}
+
+func TestHeartbeater(t *testing.T) {
+	srv := &registryServer{forgetAt: 2}
+	info := &eventpb.AgentInfo{AgentId: "agent-1", ClusterId: "cluster-1"}
+	status := func() *eventpb.AgentStatus {
+		return &eventpb.AgentStatus{Synced: true, QueueDepth: 7}
+	}
+	heartbeater := NewHeartbeater(dialServer(t, srv), info, status,
+		HeartbeatConfig{Interval: 10 * time.Millisecond, Timeout: time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		heartbeater.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if registrations, heartbeats := srv.counts(); registrations >= 2 && len(heartbeats) >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for registrations and heartbeats")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	// The hub forgot the agent on the second heartbeat, so it registered again
+	registrations, heartbeats := srv.counts()
+	if registrations < 2 {
+		t.Fatalf("Expected the agent to register again, got %d registrations", registrations)
+	}
+	heartbeat := heartbeats[0]
+	if heartbeat.AgentId != "agent-1" || heartbeat.ClusterId != "cluster-1" || heartbeat.QueueDepth != 7 {
+		t.Fatalf("Unexpected heartbeat: %+v", heartbeat)
+	}
+}
+
+func TestHeartbeaterUnimplemented(t *testing.T) {
+	heartbeater := NewHeartbeater(dialServer(t, &eventpb.UnimplementedEventServiceServer{}), &eventpb.AgentInfo{},
+		func() *eventpb.AgentStatus { return &eventpb.AgentStatus{} },
+		HeartbeatConfig{Interval: 10 * time.Millisecond, Timeout: time.Second})
+
+	done := make(chan struct{})
+	go func() {
+		heartbeater.Run(context.Background())
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected heartbeats to stop on a hub without RegisterAgent")
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+// OverflowPolicy decides what happens to an event sent to a full queue.
+type OverflowPolicy string
+
+const (
+	// PolicyBlock makes the sender wait until there is room in the queue.
+	PolicyBlock OverflowPolicy = "block"
+	// PolicyDropOldest discards the oldest queued event to make room for the new one.
+	PolicyDropOldest OverflowPolicy = "drop-oldest"
+	// PolicyDropNewest discards the event being sent.
+	PolicyDropNewest OverflowPolicy = "drop-newest"
+)
+
+// ErrQueueClosed is returned when sending to a queue that has been closed.
+var ErrQueueClosed = errors.New("event queue is closed")
+
+// QueueConfig configures a Queue.
+type QueueConfig struct {
+	// Size is the maximum number of events waiting to be sent.
+	Size int
+	// Workers is the number of events sent to the hub concurrently. Events of one object
+	// always go to the same worker, so that they are sent in order.
+	Workers int
+	// Policy decides what happens when the queue is full.
+	Policy OverflowPolicy
+	// DrainTimeout bounds how long Close keeps sending queued events.
+	DrainTimeout time.Duration
+	// BatchSize is the largest number of events a worker hands to the sink at once.
+	BatchSize int
+	// BatchDelay is how long a worker waits for a batch to fill up.
+	BatchDelay time.Duration
+}
+
+// QueueConfigFromEnv reads the queue configuration from QUEUE_SIZE, QUEUE_WORKERS
+// and QUEUE_OVERFLOW_POLICY, falling back to defaults for unset or invalid values.
+func QueueConfigFromEnv() QueueConfig {
+	config := QueueConfig{
+		Size:         1000,
+		Workers:      1,
+		Policy:       PolicyDropOldest,
+		DrainTimeout: 10 * time.Second,
+	}
+	if size, err := strconv.Atoi(os.Getenv("QUEUE_SIZE")); err == nil && size > 0 {
+		config.Size = size
+	}
+	if workers, err := strconv.Atoi(os.Getenv("QUEUE_WORKERS")); err == nil && workers > 0 {
+		config.Workers = workers
+	}
+	switch policy := OverflowPolicy(os.Getenv("QUEUE_OVERFLOW_POLICY")); policy {
+	case PolicyBlock, PolicyDropOldest, PolicyDropNewest:
+		config.Policy = policy
+	case "":
+	default:
+		log.Printf("Unknown QUEUE_OVERFLOW_POLICY %q, using %s", policy, config.Policy)
+	}
+	return config
+}
+
+// QueueStats are the counters of a Queue.
+type QueueStats struct {
+	Depth   int    `json:"depth"`
+	Sent    uint64 `json:"sent"`
+	Failed  uint64 `json:"failed"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// Queue is an EventSink that buffers events in memory and sends them to another sink
+// from a pool of workers, so that a slow hub does not stall event processing. Workers
+// hand queued events to the sink in batches and count each of them as sent or failed.
+// Each worker has its own share of the queue, holding the events of the objects it sends.
+type Queue struct {
+	sink       EventSink
+	policy     OverflowPolicy
+	shards     []chan *eventpb.EventMessage
+	batchSize  int
+	batchDelay time.Duration
+
+	// mu guards closed; Send holds it for reading so Close cannot close shards mid-send
+	mu     sync.RWMutex
+	closed bool
+
+	workers      sync.WaitGroup
+	drainTimeout time.Duration
+	drainCtx     context.Context
+	cancelDrain  context.CancelFunc
+
+	sent    atomic.Uint64
+	failed  atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// NewQueue creates a queue in front of sink and starts its workers.
+func NewQueue(sink EventSink, config QueueConfig) *Queue {
+	drainCtx, cancelDrain := context.WithCancel(context.Background())
+	q := &Queue{
+		sink:         sink,
+		policy:       config.Policy,
+		batchSize:    config.BatchSize,
+		batchDelay:   config.BatchDelay,
+		drainTimeout: config.DrainTimeout,
+		drainCtx:     drainCtx,
+		cancelDrain:  cancelDrain,
+	}
+
+	// Split the queue evenly between the workers
+	workers := config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	size := config.Size / workers
+	if size < 1 {
+		size = 1
+	}
+	for i := 0; i < workers; i++ {
+		events := make(chan *eventpb.EventMessage, size)
+		q.shards = append(q.shards, events)
+		q.workers.Add(1)
+		go q.work(events)
+	}
+	return q
+}
+
+// Send queues an event. When the queue is full the configured overflow policy applies;
+// dropped events are counted rather than reported as errors.
+func (q *Queue) Send(ctx context.Context, eventMessage *eventpb.EventMessage) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	events := q.shard(eventMessage)
+	switch q.policy {
+	case PolicyBlock:
+		select {
+		case events <- eventMessage:
+			return nil
+		case <-ctx.Done():
+			q.dropped.Add(1)
+			return ctx.Err()
+		}
+	case PolicyDropNewest:
+		select {
+		case events <- eventMessage:
+		default:
+			q.dropped.Add(1)
+		}
+		return nil
+	default:
+		for {
+			select {
+			case events <- eventMessage:
+				return nil
+			default:
+			}
+			// Make room by discarding the oldest event, unless a worker just took it
+			select {
+			case <-events:
+				q.dropped.Add(1)
+			default:
+			}
+		}
+	}
+}
+
+// shard returns the share of the queue holding the events of the object of eventMessage.
+func (q *Queue) shard(eventMessage *eventpb.EventMessage) chan *eventpb.EventMessage {
+	if len(q.shards) == 1 {
+		return q.shards[0]
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(eventMessage.Kind + "/" + eventMessage.Namespace + "/" + eventMessage.ResourceKey))
+	return q.shards[hash.Sum32()%uint32(len(q.shards))]
+}
+
+// work sends the events of its share of the queue until the queue is closed and drained.
+func (q *Queue) work(events chan *eventpb.EventMessage) {
+	defer q.workers.Done()
+	for eventMessage := range events {
+		q.deliver(q.collect(eventMessage, events))
+	}
+}
+
+// collect adds the events queued after first to its batch, waiting at most the batch
+// delay for the batch to fill up.
+func (q *Queue) collect(first *eventpb.EventMessage, events chan *eventpb.EventMessage) []*eventpb.EventMessage {
+	batch := []*eventpb.EventMessage{first}
+	if q.batchSize <= 1 {
+		return batch
+	}
+
+	timer := time.NewTimer(q.batchDelay)
+	defer timer.Stop()
+	for len(batch) < q.batchSize {
+		select {
+		case eventMessage, ok := <-events:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, eventMessage)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// deliver sends a batch to the sink. An event the sink fails to deliver is counted
+// as failed and the rest of the batch is sent on.
+func (q *Queue) deliver(batch []*eventpb.EventMessage) {
+	for len(batch) > 0 {
+		if q.drainCtx.Err() != nil {
+			// Close gave up on draining the queue
+			q.dropped.Add(uint64(len(batch)))
+			return
+		}
+		n, err := sendBatch(q.drainCtx, q.sink, batch)
+		q.sent.Add(uint64(n))
+		if err == nil || n >= len(batch) {
+			return
+		}
+		q.failed.Add(1)
+		log.Printf("Error sending event %s/%s: %v", batch[n].Namespace, batch[n].ResourceKey, err)
+		batch = batch[n+1:]
+	}
+}
+
+// Stats returns the current counters of the queue.
+func (q *Queue) Stats() QueueStats {
+	depth := 0
+	for _, events := range q.shards {
+		depth += len(events)
+	}
+	return QueueStats{
+		Depth:   depth,
+		Sent:    q.sent.Load(),
+		Failed:  q.failed.Load(),
+		Dropped: q.dropped.Load(),
+	}
+}
+
+// Close stops accepting events, sends what is still queued for at most the drain
+// timeout, and closes the underlying sink.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	for _, events := range q.shards {
+		close(events)
+	}
+	q.mu.Unlock()
+
+	timer := time.AfterFunc(q.drainTimeout, q.cancelDrain)
+	q.workers.Wait()
+	timer.Stop()
+	q.cancelDrain()
+
+	return q.sink.Close()
+}
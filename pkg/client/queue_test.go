@@ -0,0 +1,216 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+// gatedSink records events but blocks every Send until the gate is opened.
+type gatedSink struct {
+	recordingSink
+	gate   chan struct{}
+	closed atomic.Bool
+}
+
+func newGatedSink() *gatedSink {
+	return &gatedSink{gate: make(chan struct{})}
+}
+
+func (s *gatedSink) Send(ctx context.Context, eventMessage *eventpb.EventMessage) error {
+	select {
+	case <-s.gate:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.recordingSink.Send(ctx, eventMessage)
+}
+
+func (s *gatedSink) Close() error {
+	s.closed.Store(true)
+	return nil
+}
+
+// fillQueue sends events until one is held by the single worker and the queue is full.
+func fillQueue(t *testing.T, q *Queue, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		if err := q.Send(context.Background(), &eventpb.EventMessage{ResourceKey: key}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		// Give the worker the chance to pick up the first event
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	sink := newGatedSink()
+	q := NewQueue(sink, QueueConfig{Size: 2, Workers: 1, Policy: PolicyDropOldest, DrainTimeout: time.Second})
+
+	// "a" is held by the worker, "b" and "c" fill the queue, "d" pushes out "b"
+	fillQueue(t, q, "a", "b", "c", "d")
+	if stats := q.Stats(); stats.Dropped != 1 || stats.Depth != 2 {
+		t.Fatalf("Expected 1 dropped and 2 queued, got %+v", stats)
+	}
+
+	close(sink.gate)
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if got := sink.keys(); len(got) != 3 || got[0] != "a" || got[1] != "c" || got[2] != "d" {
+		t.Fatalf("Expected a, c and d to be sent, got %v", got)
+	}
+	if stats := q.Stats(); stats.Sent != 3 {
+		t.Fatalf("Expected 3 sent, got %+v", stats)
+	}
+	if !sink.closed.Load() {
+		t.Fatal("Expected Close to close the underlying sink")
+	}
+}
+
+func TestQueueDropNewest(t *testing.T) {
+	sink := newGatedSink()
+	q := NewQueue(sink, QueueConfig{Size: 1, Workers: 1, Policy: PolicyDropNewest, DrainTimeout: time.Second})
+
+	fillQueue(t, q, "a", "b", "c")
+	close(sink.gate)
+	_ = q.Close()
+
+	if got := sink.keys(); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("Expected a and b to be sent, got %v", got)
+	}
+	if stats := q.Stats(); stats.Dropped != 1 {
+		t.Fatalf("Expected 1 dropped, got %+v", stats)
+	}
+}
+
+func TestQueueBlock(t *testing.T) {
+	sink := newGatedSink()
+	q := NewQueue(sink, QueueConfig{Size: 1, Workers: 1, Policy: PolicyBlock, DrainTimeout: time.Second})
+	fillQueue(t, q, "a", "b")
+
+	// The queue is full, so a send blocks until its context expires
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.Send(ctx, &eventpb.EventMessage{ResourceKey: "c"}); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the send to block until the deadline, got %v", err)
+	}
+
+	close(sink.gate)
+	_ = q.Close()
+	if err := q.Send(context.Background(), &eventpb.EventMessage{}); err != ErrQueueClosed {
+		t.Fatalf("Expected ErrQueueClosed after Close, got %v", err)
+	}
+}
+
+func TestQueueCloseDrainTimeout(t *testing.T) {
+	sink := newGatedSink()
+	q := NewQueue(sink, QueueConfig{Size: 2, Workers: 1, Policy: PolicyBlock, DrainTimeout: 20 * time.Millisecond})
+	fillQueue(t, q, "a", "b", "c")
+
+	// The hub never answers, so Close gives up after the drain timeout
+	_ = q.Close()
+	if stats := q.Stats(); stats.Sent != 0 || stats.Failed != 1 || stats.Dropped != 2 {
+		t.Fatalf("Expected 1 failed and 2 dropped events, got %+v", stats)
+	}
+}
+
+// batchRecordingSink records the batches sent to it and rejects events with the key "bad".
+type batchRecordingSink struct {
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func (s *batchRecordingSink) Send(ctx context.Context, eventMessage *eventpb.EventMessage) error {
+	_, err := s.SendBatch(ctx, []*eventpb.EventMessage{eventMessage})
+	return err
+}
+
+func (s *batchRecordingSink) SendBatch(ctx context.Context, batch []*eventpb.EventMessage) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for _, eventMessage := range batch {
+		keys = append(keys, eventMessage.ResourceKey)
+	}
+	s.batches = append(s.batches, keys)
+	for i, key := range keys {
+		if key == "bad" {
+			return i, status.Error(codes.InvalidArgument, "bad event")
+		}
+	}
+	return len(batch), nil
+}
+
+func (s *batchRecordingSink) Close() error {
+	return nil
+}
+
+func TestQueueBatches(t *testing.T) {
+	sink := &batchRecordingSink{}
+	q := NewQueue(sink, QueueConfig{Size: 10, Workers: 1, Policy: PolicyBlock, DrainTimeout: time.Second,
+		BatchSize: 3, BatchDelay: time.Second})
+
+	for _, key := range []string{"a", "bad", "b", "c"} {
+		if err := q.Send(context.Background(), &eventpb.EventMessage{ResourceKey: key}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	_ = q.Close()
+
+	// The rejected event is counted as failed and the rest of its batch is sent on
+	if got := fmt.Sprint(sink.batches); got != "[[a bad b] [b] [c]]" {
+		t.Fatalf("Expected the batch to resume after the rejected event, got %s", got)
+	}
+	if stats := q.Stats(); stats.Sent != 3 || stats.Failed != 1 {
+		t.Fatalf("Expected 3 sent and 1 failed, got %+v", stats)
+	}
+}
+
+func TestQueueKeepsObjectOrder(t *testing.T) {
+	sink := &recordingSink{}
+	q := NewQueue(sink, QueueConfig{Size: 400, Workers: 4, Policy: PolicyBlock, DrainTimeout: time.Second})
+
+	for i := 0; i < 200; i++ {
+		eventMessage := &eventpb.EventMessage{Kind: "Pod", Namespace: "default", ResourceKey: fmt.Sprintf("pod-%d", i%5), Sequence: uint64(i)}
+		if err := q.Send(context.Background(), eventMessage); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	_ = q.Close()
+
+	// Workers run concurrently, but the events of one object are sent in order
+	last := map[string]uint64{}
+	for _, eventMessage := range sink.sent() {
+		if previous, ok := last[eventMessage.ResourceKey]; ok && eventMessage.Sequence < previous {
+			t.Fatalf("Event %d of %s was sent after event %d", eventMessage.Sequence, eventMessage.ResourceKey, previous)
+		}
+		last[eventMessage.ResourceKey] = eventMessage.Sequence
+	}
+	if stats := q.Stats(); stats.Sent != 200 {
+		t.Fatalf("Expected 200 sent, got %+v", stats)
+	}
+}
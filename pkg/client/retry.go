@@ -0,0 +1,140 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+// RetryConfig configures a RetryingSink.
+type RetryConfig struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry; it doubles on every further retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between two attempts.
+	MaxBackoff time.Duration
+	// Jitter is the fraction of each wait that is randomized, between 0 and 1, so that
+	// agents do not retry against a recovering hub in lockstep.
+	Jitter float64
+}
+
+// RetryConfigFromEnv reads the retry configuration from RETRY_MAX_ATTEMPTS,
+// RETRY_INITIAL_BACKOFF and RETRY_MAX_BACKOFF, falling back to defaults for unset or invalid values.
+func RetryConfigFromEnv() RetryConfig {
+	config := RetryConfig{
+		MaxAttempts:    5,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		Jitter:         0.2,
+	}
+	if attempts, err := strconv.Atoi(os.Getenv("RETRY_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		config.MaxAttempts = attempts
+	}
+	if backoff, err := time.ParseDuration(os.Getenv("RETRY_INITIAL_BACKOFF")); err == nil && backoff > 0 {
+		config.InitialBackoff = backoff
+	}
+	if backoff, err := time.ParseDuration(os.Getenv("RETRY_MAX_BACKOFF")); err == nil && backoff > 0 {
+		config.MaxBackoff = backoff
+	}
+	return config
+}
+
+// RetryingSink is an EventSink that retries failed sends to another sink with
+// exponential backoff, as long as the failure is one the hub may recover from.
+type RetryingSink struct {
+	sink   EventSink
+	config RetryConfig
+}
+
+// NewRetryingSink wraps sink with the given retry behavior.
+func NewRetryingSink(sink EventSink, config RetryConfig) *RetryingSink {
+	return &RetryingSink{sink: sink, config: config}
+}
+
+// Send sends the event, retrying retryable failures until the attempts are
+// exhausted or ctx is done. The last error is returned.
+func (s *RetryingSink) Send(ctx context.Context, eventMessage *eventpb.EventMessage) error {
+	_, err := s.SendBatch(ctx, []*eventpb.EventMessage{eventMessage})
+	return err
+}
+
+// SendBatch sends the events, resuming from the first undelivered one after a retryable
+// failure until the attempts are exhausted or ctx is done.
+func (s *RetryingSink) SendBatch(ctx context.Context, batch []*eventpb.EventMessage) (int, error) {
+	delivered := 0
+	for attempt := 1; ; attempt++ {
+		n, err := sendBatch(ctx, s.sink, batch[delivered:])
+		delivered += n
+		if err == nil {
+			return delivered, nil
+		}
+		if !isRetryable(err) || attempt >= s.config.MaxAttempts {
+			return delivered, err
+		}
+
+		backoff := s.backoff(attempt)
+		eventMessage := batch[delivered]
+		log.Printf("Sending event %s/%s failed (attempt %d/%d), retrying in %s: %v",
+			eventMessage.Namespace, eventMessage.ResourceKey, attempt, s.config.MaxAttempts, backoff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return delivered, err
+		}
+	}
+}
+
+// backoff returns the jittered wait after the given failed attempt.
+func (s *RetryingSink) backoff(attempt int) time.Duration {
+	backoff := s.config.InitialBackoff
+	for i := 1; i < attempt && backoff < s.config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.config.MaxBackoff {
+		backoff = s.config.MaxBackoff
+	}
+	return backoff - time.Duration(s.config.Jitter*rand.Float64()*float64(backoff))
+}
+
+// Close closes the underlying sink.
+func (s *RetryingSink) Close() error {
+	return s.sink.Close()
+}
+
+// isRetryable reports whether a failed send may succeed if tried again. Only failures
+// signalling a temporarily unavailable or overloaded hub are retried; rejected events
+// (e.g. InvalidArgument, Unauthenticated) would be rejected again.
+func isRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+// failingSink fails with the given errors in order, then succeeds. It records the events
+// it delivers.
+type failingSink struct {
+	recordingSink
+	errs     []error
+	attempts int
+}
+
+func (s *failingSink) Send(ctx context.Context, eventMessage *eventpb.EventMessage) error {
+	s.attempts++
+	if s.attempts <= len(s.errs) && s.errs[s.attempts-1] != nil {
+		return s.errs[s.attempts-1]
+	}
+	return s.recordingSink.Send(ctx, eventMessage)
+}
+
+func TestRetryingSink(t *testing.T) {
+	config := RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond, Jitter: 0.2}
+	unavailable := status.Error(codes.Unavailable, "hub restarting")
+
+	tests := []struct {
+		name             string
+		errs             []error
+		expectedAttempts int
+		expectedCode     codes.Code
+	}{
+		{"succeeds first time", nil, 1, codes.OK},
+		{"retries transient failures", []error{unavailable, status.Error(codes.DeadlineExceeded, "slow")}, 3, codes.OK},
+		{"gives up after max attempts", []error{unavailable, unavailable, unavailable, unavailable}, 3, codes.Unavailable},
+		{"does not retry invalid events", []error{status.Error(codes.InvalidArgument, "bad event")}, 1, codes.InvalidArgument},
+		{"does not retry unauthenticated", []error{status.Error(codes.Unauthenticated, "bad key")}, 1, codes.Unauthenticated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &failingSink{errs: tt.errs}
+			err := NewRetryingSink(sink, config).Send(context.Background(), &eventpb.EventMessage{})
+			if status.Code(err) != tt.expectedCode {
+				t.Errorf("Expected %s, got %v", tt.expectedCode, err)
+			}
+			if sink.attempts != tt.expectedAttempts {
+				t.Errorf("Expected %d attempts, got %d", tt.expectedAttempts, sink.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryingSinkResumesBatch(t *testing.T) {
+	// "a" is delivered and "b" fails once, so the retry starts again at "b"
+	sink := &failingSink{errs: []error{nil, status.Error(codes.Unavailable, "hub restarting")}}
+	batch := []*eventpb.EventMessage{{ResourceKey: "a"}, {ResourceKey: "b"}, {ResourceKey: "c"}}
+
+	n, err := NewRetryingSink(sink, RetryConfig{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}).
+		SendBatch(context.Background(), batch)
+	if n != 3 || err != nil || sink.attempts != 4 {
+		t.Fatalf("Expected 3 events delivered in 4 attempts, got %d and %v after %d attempts", n, err, sink.attempts)
+	}
+}
+
+func TestRetryingSinkBackoff(t *testing.T) {
+	s := NewRetryingSink(nil, RetryConfig{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.5})
+
+	for attempt, expected := range map[int]time.Duration{1: 100 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second} {
+		backoff := s.backoff(attempt)
+		if backoff > expected || backoff < expected/2 {
+			t.Errorf("Backoff after attempt %d = %s, expected between %s and %s", attempt, backoff, expected/2, expected)
+		}
+	}
+}
+
+func TestRetryingSinkContextCanceled(t *testing.T) {
+	sink := &failingSink{errs: []error{status.Error(codes.Unavailable, "down"), status.Error(codes.Unavailable, "down")}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := NewRetryingSink(sink, RetryConfig{MaxAttempts: 3, InitialBackoff: time.Hour, MaxBackoff: time.Hour}).Send(ctx, &eventpb.EventMessage{})
+	if status.Code(err) != codes.Unavailable || sink.attempts != 1 {
+		t.Fatalf("Expected to stop after the first attempt, got %v after %d attempts", err, sink.attempts)
+	}
+}
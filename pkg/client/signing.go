@@ -0,0 +1,248 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/protobuf/proto"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+// Supported signature algorithms.
+const (
+	AlgorithmHMACSHA256 = "HMAC-SHA256"
+	AlgorithmEd25519    = "Ed25519"
+)
+
+// SigningConfig configures the signing of events.
+type SigningConfig struct {
+	// Algorithm is HMAC-SHA256 or Ed25519; events are only numbered when it is empty.
+	Algorithm string
+	// KeyFile holds the base64-encoded shared key for HMAC-SHA256, or the PEM PKCS #8
+	// private key of the agent for Ed25519.
+	KeyFile string
+}
+
+// SigningConfigFromEnv reads the signing configuration from SIGNING_ALGORITHM and SIGNING_KEY_FILE.
+func SigningConfigFromEnv() SigningConfig {
+	config := SigningConfig{
+		Algorithm: os.Getenv("SIGNING_ALGORITHM"),
+		KeyFile:   os.Getenv("SIGNING_KEY_FILE"),
+	}
+	if config.Algorithm == "none" {
+		config.Algorithm = ""
+	}
+	return config
+}
+
+// SigningSink is a BatchSink that numbers every event of the agent and, if configured,
+// signs it so that the hub and downstream audit systems can verify where it comes from and
+// that it was not altered. Together with the agent ID, the sequence number lets them detect
+// dropped and replayed events. It must come after encryption, so that the ciphertext is signed,
+// and after the queue, so that events are numbered when they are delivered: a gap in the
+// sequence is then a number whose event was not delivered under it.
+type SigningSink struct {
+	sink    EventSink
+	agentID string
+
+	// sequence is the last number taken. Batches take their numbers at once and are
+	// delivered concurrently, so they may reach the hub out of order.
+	sequence atomic.Uint64
+
+	algorithm string
+	key       func() (string, error)
+
+	// mu guards the signing function of the current key
+	mu      sync.Mutex
+	encoded string
+	keyID   string
+	sign    func([]byte) []byte
+}
+
+// NewSigningSink creates a sink numbering the events of agentID and signing them for sink.
+// It fails if the algorithm is not supported or the key cannot be loaded.
+func NewSigningSink(sink EventSink, agentID string, config SigningConfig) (*SigningSink, error) {
+	s := &SigningSink{
+		sink:      sink,
+		agentID:   agentID,
+		algorithm: config.Algorithm,
+	}
+	if config.Algorithm == "" {
+		return s, nil
+	}
+
+	if config.Algorithm != AlgorithmHMACSHA256 && config.Algorithm != AlgorithmEd25519 {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", config.Algorithm)
+	}
+	if config.KeyFile == "" {
+		return nil, errors.New("signing requires SIGNING_KEY_FILE")
+	}
+	s.key = (&fileKey{path: config.KeyFile}).read
+	if _, _, err := s.signer(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// signer returns the signing function and key ID of the current key.
+func (s *SigningSink) signer() (func([]byte) []byte, string, error) {
+	encoded, err := s.key()
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sign != nil && encoded == s.encoded {
+		return s.sign, s.keyID, nil
+	}
+
+	switch s.algorithm {
+	case AlgorithmHMACSHA256:
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not decode signing key: %w", err)
+		}
+		if len(key) < 32 {
+			return nil, "", errors.New("HMAC-SHA256 signing key must be at least 32 bytes")
+		}
+		s.sign = func(data []byte) []byte {
+			mac := hmac.New(sha256.New, key)
+			mac.Write(data)
+			return mac.Sum(nil)
+		}
+		s.keyID = keyID(key)
+	case AlgorithmEd25519:
+		block, _ := pem.Decode([]byte(encoded))
+		if block == nil {
+			return nil, "", errors.New("no PEM private key found in signing key file")
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not parse signing key: %w", err)
+		}
+		key, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, "", fmt.Errorf("signing key is a %T, not an Ed25519 key", parsed)
+		}
+		s.sign = func(data []byte) []byte {
+			return ed25519.Sign(key, data)
+		}
+		s.keyID = keyID(key.Public().(ed25519.PublicKey))
+	}
+	s.encoded = encoded
+	return s.sign, s.keyID, nil
+}
+
+// Send numbers and signs the event and passes it on. The event itself is left unchanged.
+func (s *SigningSink) Send(ctx context.Context, eventMessage *eventpb.EventMessage) error {
+	_, err := s.SendBatch(ctx, []*eventpb.EventMessage{eventMessage})
+	return err
+}
+
+// SendBatch numbers and signs the events and passes them on. The numbers of an event that
+// fails and of the events after it that were not sent stay unused, so that the gap shows they
+// were not delivered; the unsent events get new numbers when they are sent again.
+func (s *SigningSink) SendBatch(ctx context.Context, batch []*eventpb.EventMessage) (int, error) {
+	var sign func([]byte) []byte
+	var keyID string
+	if s.algorithm != "" {
+		var err error
+		if sign, keyID, err = s.signer(); err != nil {
+			return 0, err
+		}
+	}
+
+	first := s.sequence.Add(uint64(len(batch))) - uint64(len(batch)) + 1
+	signed := make([]*eventpb.EventMessage, 0, len(batch))
+	for i, eventMessage := range batch {
+		signed = append(signed, s.signEvent(eventMessage, first+uint64(i), sign, keyID))
+	}
+	return sendBatch(ctx, s.sink, signed)
+}
+
+// signEvent returns a copy of the event with the given number, signed with sign if set.
+func (s *SigningSink) signEvent(eventMessage *eventpb.EventMessage, sequence uint64, sign func([]byte) []byte, keyID string) *eventpb.EventMessage {
+	signed := proto.Clone(eventMessage).(*eventpb.EventMessage)
+	signed.AgentId = s.agentID
+	signed.Sequence = sequence
+	signed.Signature = nil
+	if sign == nil {
+		return signed
+	}
+
+	signed.Signature = &eventpb.Signature{
+		Algorithm: s.algorithm,
+		KeyId:     keyID,
+		Value:     sign(canonicalEvent(signed)),
+	}
+	return signed
+}
+
+// Close closes the underlying sink.
+func (s *SigningSink) Close() error {
+	return s.sink.Close()
+}
+
+// VerifySignature verifies the signature of an event, as the hub does. keys maps key IDs to
+// the shared key ([]byte) for HMAC-SHA256, or to the agent's ed25519.PublicKey for Ed25519.
+func VerifySignature(eventMessage *eventpb.EventMessage, keys map[string]interface{}) error {
+	signature := eventMessage.Signature
+	if signature == nil {
+		return errors.New("event is not signed")
+	}
+	key, ok := keys[signature.KeyId]
+	if !ok {
+		return fmt.Errorf("unknown signing key %s", signature.KeyId)
+	}
+	data := canonicalEvent(eventMessage)
+
+	switch signature.Algorithm {
+	case AlgorithmHMACSHA256:
+		sharedKey, ok := key.([]byte)
+		if !ok {
+			return fmt.Errorf("key %s is not an HMAC key", signature.KeyId)
+		}
+		mac := hmac.New(sha256.New, sharedKey)
+		mac.Write(data)
+		if !hmac.Equal(mac.Sum(nil), signature.Value) {
+			return errors.New("invalid signature")
+		}
+	case AlgorithmEd25519:
+		publicKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("key %s is not an Ed25519 public key", signature.KeyId)
+		}
+		if !ed25519.Verify(publicKey, data, signature.Value) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", signature.Algorithm)
+	}
+	return nil
+}
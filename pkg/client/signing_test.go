@@ -0,0 +1,202 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+func TestSigningSinkHMAC(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	path := filepath.Join(t.TempDir(), "key")
+	writeKey(t, path, base64.StdEncoding.EncodeToString(key), time.Now())
+
+	recorder := &recordingSink{}
+	sink, err := NewSigningSink(recorder, "agent-1", SigningConfig{Algorithm: AlgorithmHMACSHA256, KeyFile: path})
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+
+	original := &eventpb.EventMessage{Name: "web", Data: []byte("{}")}
+	for i := 0; i < 3; i++ {
+		if err := sink.Send(context.Background(), original); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	if original.Sequence != 0 || original.Signature != nil {
+		t.Fatal("Expected the original event to be left unchanged")
+	}
+
+	keys := map[string]interface{}{keyID(key): key}
+	for i, signed := range recorder.sent() {
+		if signed.AgentId != "agent-1" || signed.Sequence != uint64(i+1) {
+			t.Fatalf("Expected event %d of agent-1, got %d of %s", i+1, signed.Sequence, signed.AgentId)
+		}
+		if err := VerifySignature(signed, keys); err != nil {
+			t.Fatalf("Expected a valid signature: %v", err)
+		}
+	}
+
+	// Changing any signed field, including the sequence number, invalidates the signature
+	replayed := recorder.sent()[0]
+	replayed.Sequence = 4
+	if err := VerifySignature(replayed, keys); err == nil {
+		t.Fatal("Expected a renumbered event to fail verification")
+	}
+	tampered := recorder.sent()[1]
+	tampered.Data = []byte(`{"changed":true}`)
+	if err := VerifySignature(tampered, keys); err == nil {
+		t.Fatal("Expected tampered data to fail verification")
+	}
+}
+
+func TestSigningSinkEd25519(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "key")
+	writeKey(t, path, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), time.Now())
+
+	recorder := &recordingSink{}
+	sink, err := NewSigningSink(recorder, "agent-1", SigningConfig{Algorithm: AlgorithmEd25519, KeyFile: path})
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+	if err := sink.Send(context.Background(), &eventpb.EventMessage{Name: "web"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	signed := recorder.sent()[0]
+	if err := VerifySignature(signed, map[string]interface{}{keyID(publicKey): publicKey}); err != nil {
+		t.Fatalf("Expected a valid signature: %v", err)
+	}
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	if err := VerifySignature(signed, map[string]interface{}{keyID(publicKey): otherKey}); err == nil {
+		t.Fatal("Expected verification with another key to fail")
+	}
+}
+
+func TestSigningSinkNumbersDeliveredEvents(t *testing.T) {
+	// The hub rejects "b", so "c" is not sent with the batch
+	recorder := &failingSink{errs: []error{nil, status.Error(codes.InvalidArgument, "bad event")}}
+	sink, err := NewSigningSink(recorder, "agent-1", SigningConfig{})
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+	batch := []*eventpb.EventMessage{{ResourceKey: "a"}, {ResourceKey: "b"}, {ResourceKey: "c"}}
+	if n, err := sink.SendBatch(context.Background(), batch); n != 1 || status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected the batch to stop at the rejected event, got %d and %v", n, err)
+	}
+	if err := sink.Send(context.Background(), batch[2]); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	// The rejected and the unsent event leave a gap, and the unsent one is numbered again when it is sent
+	var got []string
+	for _, signed := range recorder.sent() {
+		got = append(got, fmt.Sprintf("%s=%d", signed.ResourceKey, signed.Sequence))
+	}
+	if fmt.Sprint(got) != "[a=1 c=4]" {
+		t.Fatalf("Expected a=1 and c=4, got %v", got)
+	}
+}
+
+// rendezvousSink holds every event until as many sends as were added to arrived are in progress.
+type rendezvousSink struct {
+	recordingSink
+	arrived sync.WaitGroup
+}
+
+func (s *rendezvousSink) Send(ctx context.Context, eventMessage *eventpb.EventMessage) error {
+	s.arrived.Done()
+	s.arrived.Wait()
+	return s.recordingSink.Send(ctx, eventMessage)
+}
+
+func TestSigningSinkDeliversConcurrently(t *testing.T) {
+	recorder := &rendezvousSink{}
+	recorder.arrived.Add(2)
+	sink, err := NewSigningSink(recorder, "agent-1", SigningConfig{})
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+
+	// Neither send completes unless both are delivered at the same time
+	done := make(chan error, 2)
+	for _, key := range []string{"a", "b"} {
+		go func() { done <- sink.Send(context.Background(), &eventpb.EventMessage{ResourceKey: key}) }()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected events to be delivered concurrently")
+		}
+	}
+
+	sequences := map[uint64]bool{}
+	for _, signed := range recorder.sent() {
+		sequences[signed.Sequence] = true
+	}
+	if !sequences[1] || !sequences[2] {
+		t.Fatalf("Expected the events to be numbered 1 and 2, got %v", sequences)
+	}
+}
+
+func TestSigningSinkUnsigned(t *testing.T) {
+	recorder := &recordingSink{}
+	sink, err := NewSigningSink(recorder, "agent-1", SigningConfig{})
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+	if err := sink.Send(context.Background(), &eventpb.EventMessage{}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	// Without a key, events are still numbered
+	if signed := recorder.sent()[0]; signed.Sequence != 1 || signed.Signature != nil {
+		t.Fatalf("Expected an unsigned event numbered 1, got %+v", signed)
+	}
+
+	if _, err := NewSigningSink(recorder, "agent-1", SigningConfig{Algorithm: "MD5", KeyFile: "key"}); err == nil {
+		t.Fatal("Expected an unsupported algorithm to be rejected")
+	}
+}
@@ -0,0 +1,630 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+const (
+	segmentPrefix = "segment-"
+	segmentSuffix = ".log"
+	// recordHeaderSize is the size of the header preceding every spooled event:
+	// the time it was spooled (int64), the payload length (uint32) and its CRC-32 (uint32).
+	recordHeaderSize = 16
+)
+
+// SpoolConfig configures a Spool.
+type SpoolConfig struct {
+	// Dir is the directory holding the segment files, normally on a mounted volume.
+	Dir string
+	// MaxBytes bounds the size of all segments; the oldest segments are dropped beyond it.
+	MaxBytes int64
+	// MaxAge bounds how long an event is kept; older events are dropped instead of replayed.
+	MaxAge time.Duration
+	// SegmentBytes is the size at which a new segment file is started.
+	SegmentBytes int64
+	// Sync is when spooled events are flushed to disk.
+	Sync SpoolSync
+}
+
+// SpoolSync is when spooled events are flushed to disk, so that they survive a node crash.
+type SpoolSync string
+
+const (
+	// SyncPerBatch flushes the events spooled together once, after the last of them.
+	SyncPerBatch SpoolSync = "batch"
+	// SyncPerEvent flushes every event as soon as it is spooled.
+	SyncPerEvent SpoolSync = "event"
+)
+
+// SpoolConfigFromEnv reads the spool configuration from SPOOL_DIR, SPOOL_MAX_BYTES,
+// SPOOL_MAX_AGE and SPOOL_SYNC. It returns false if SPOOL_DIR is not set, i.e. spooling is disabled.
+func SpoolConfigFromEnv() (SpoolConfig, bool) {
+	config := SpoolConfig{
+		Dir:      os.Getenv("SPOOL_DIR"),
+		MaxBytes: 256 << 20,
+		MaxAge:   24 * time.Hour,
+		Sync:     SyncPerBatch,
+	}
+	if config.Dir == "" {
+		return config, false
+	}
+	if value := os.Getenv("SPOOL_MAX_BYTES"); value != "" {
+		if quantity, err := resource.ParseQuantity(value); err == nil && quantity.Value() > 0 {
+			config.MaxBytes = quantity.Value()
+		} else {
+			log.Printf("Invalid SPOOL_MAX_BYTES %q, using %d", value, config.MaxBytes)
+		}
+	}
+	if maxAge, err := time.ParseDuration(os.Getenv("SPOOL_MAX_AGE")); err == nil && maxAge > 0 {
+		config.MaxAge = maxAge
+	}
+	switch sync := SpoolSync(os.Getenv("SPOOL_SYNC")); sync {
+	case "":
+	case SyncPerBatch, SyncPerEvent:
+		config.Sync = sync
+	default:
+		log.Printf("Invalid SPOOL_SYNC %q, using %s", sync, config.Sync)
+	}
+	return config, true
+}
+
+// SpoolStats are the counters of a Spool.
+type SpoolStats struct {
+	// Depth is the number of events waiting to be replayed.
+	Depth int `json:"depth"`
+	// Bytes is the size of all segment files.
+	Bytes int64 `json:"bytes"`
+	// OldestAge is how long the oldest waiting event has been spooled, in seconds.
+	OldestAge float64 `json:"oldestAgeSeconds"`
+	// Dropped counts events discarded because of the size or age bounds.
+	Dropped uint64 `json:"dropped"`
+}
+
+// segment is a spool file. Events are appended to the last segment and read from the first.
+type segment struct {
+	seq   uint64
+	path  string
+	size  int64
+	count int
+	// sealed segments are not appended to, e.g. segments left by a previous run
+	sealed bool
+}
+
+// spooledEvent is an event read from the spool together with the time it was spooled.
+type spooledEvent struct {
+	message   *eventpb.EventMessage
+	spooledAt time.Time
+}
+
+// Spool is a write-ahead log of event messages kept in segment files, used to hold
+// events while the hub is unreachable. Events are read back in the order they were
+// appended. A segment is deleted once all its events were committed, so after a restart
+// the events of a partially replayed segment are replayed again (at-least-once delivery).
+type Spool struct {
+	mu       sync.Mutex
+	config   SpoolConfig
+	segments []*segment
+	writer   *os.File
+	reader   *bufio.Reader
+	readFile *os.File
+	// readOffset is where the next event is read in the first segment
+	readOffset int64
+	// head is the next event to replay, if it was already read
+	head    *spooledEvent
+	dropped uint64
+}
+
+// OpenSpool opens the spool in config.Dir, picking up the segments left by a previous run.
+func OpenSpool(config SpoolConfig) (*Spool, error) {
+	if config.SegmentBytes <= 0 {
+		config.SegmentBytes = config.MaxBytes / 8
+	}
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create spool directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read spool directory: %w", err)
+	}
+
+	s := &Spool{config: config}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg := &segment{seq: seq, path: filepath.Join(config.Dir, name), sealed: true}
+		if seg.size, seg.count, err = scanSegment(seg.path); err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, seg)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	if depth := s.depthLocked(); depth > 0 {
+		log.Printf("Spool %s holds %d events from a previous run", config.Dir, depth)
+	}
+	return s, nil
+}
+
+// scanSegment returns the size and number of valid events of a segment file.
+func scanSegment(path string) (int64, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not open spool segment: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not read spool segment: %w", err)
+	}
+
+	var size int64
+	count := 0
+	reader := bufio.NewReader(f)
+	for {
+		_, n, err := readRecord(reader, info.Size()-size)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("Ignoring the rest of spool segment %s: %v", path, err)
+			}
+			return size, count, nil
+		}
+		size += n
+		count++
+	}
+}
+
+// Append adds an event to the end of the spool and flushes it to disk.
+func (s *Spool) Append(eventMessage *eventpb.EventMessage) error {
+	_, err := s.AppendBatch([]*eventpb.EventMessage{eventMessage})
+	return err
+}
+
+// AppendBatch adds events to the end of the spool, dropping the oldest segments if the spool
+// would grow beyond its size bound, and flushes them to disk as configured. It returns how
+// many events were spooled.
+func (s *Spool) AppendBatch(batch []*eventpb.EventMessage) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	appended := 0
+	var err error
+	for _, eventMessage := range batch {
+		if err = s.appendLocked(eventMessage); err != nil {
+			break
+		}
+		appended++
+		if s.config.Sync == SyncPerEvent {
+			s.syncLocked()
+		}
+	}
+	if appended > 0 && s.config.Sync != SyncPerEvent {
+		s.syncLocked()
+	}
+	return appended, err
+}
+
+// syncLocked flushes the segment being written. The events stay spooled if it fails, since
+// they are lost only if the node crashes too.
+func (s *Spool) syncLocked() {
+	if s.writer == nil {
+		return
+	}
+	if err := s.writer.Sync(); err != nil {
+		log.Printf("Error flushing spool segment %s: %v", s.writer.Name(), err)
+	}
+}
+
+func (s *Spool) appendLocked(eventMessage *eventpb.EventMessage) error {
+	payload, err := proto.Marshal(eventMessage)
+	if err != nil {
+		return fmt.Errorf("could not marshal event: %w", err)
+	}
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint64(record[0:8], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(record[8:12], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[12:16], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+
+	for len(s.segments) > 0 && s.bytesLocked()+int64(len(record)) > s.config.MaxBytes {
+		s.dropOldestLocked()
+	}
+
+	last := s.lastSegmentLocked()
+	if last == nil || last.sealed || last.size >= s.config.SegmentBytes {
+		if last, err = s.newSegmentLocked(); err != nil {
+			return err
+		}
+	}
+	if s.writer == nil {
+		if s.writer, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err != nil {
+			return fmt.Errorf("could not open spool segment: %w", err)
+		}
+		// Flush the directory entry too, or the segment may be gone after a crash
+		if err := syncDir(s.config.Dir); err != nil {
+			return fmt.Errorf("could not flush spool directory: %w", err)
+		}
+	}
+	if _, err := s.writer.Write(record); err != nil {
+		return fmt.Errorf("could not write to spool: %w", err)
+	}
+	last.size += int64(len(record))
+	last.count++
+	return nil
+}
+
+// Peek returns the oldest event waiting to be replayed without removing it.
+// Events older than the age bound are dropped on the way. It returns false if the spool is empty.
+func (s *Spool) Peek() (*eventpb.EventMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		head := s.headLocked()
+		if head == nil {
+			return nil, false
+		}
+		if time.Since(head.spooledAt) <= s.config.MaxAge {
+			return head.message, true
+		}
+		s.dropped++
+		s.commitLocked()
+	}
+}
+
+// Commit removes the event returned by the last Peek.
+func (s *Spool) Commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commitLocked()
+}
+
+// Len returns the number of events waiting to be replayed.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.depthLocked()
+}
+
+// Stats returns the current counters of the spool.
+func (s *Spool) Stats() SpoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := SpoolStats{
+		Depth:   s.depthLocked(),
+		Bytes:   s.bytesLocked(),
+		Dropped: s.dropped,
+	}
+	if head := s.headLocked(); head != nil {
+		stats.OldestAge = time.Since(head.spooledAt).Seconds()
+	}
+	return stats
+}
+
+// Close closes the open segment files. Unreplayed events stay on disk for the next run.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeReaderLocked()
+	if s.writer != nil {
+		err := s.writer.Close()
+		s.writer = nil
+		return err
+	}
+	return nil
+}
+
+// headLocked reads the next event from the first segment, if not read already.
+func (s *Spool) headLocked() *spooledEvent {
+	for s.head == nil && len(s.segments) > 0 {
+		first := s.segments[0]
+		if first.count == 0 {
+			if len(s.segments) == 1 {
+				// Nothing was appended to the only segment yet
+				return nil
+			}
+			s.removeFirstLocked()
+			continue
+		}
+		if s.reader == nil {
+			f, err := os.Open(first.path)
+			if err != nil {
+				log.Printf("Dropping unreadable spool segment %s: %v", first.path, err)
+				s.dropped += uint64(first.count)
+				s.removeFirstLocked()
+				continue
+			}
+			s.readFile, s.reader = f, bufio.NewReader(f)
+		}
+
+		head, n, err := readRecord(s.reader, first.size-s.readOffset)
+		if err != nil {
+			// A truncated or corrupted record ends the segment
+			log.Printf("Dropping %d unreadable events from spool segment %s: %v", first.count, first.path, err)
+			s.dropped += uint64(first.count)
+			first.count = 0
+			first.sealed = true
+			continue
+		}
+		s.head = head
+		s.readOffset += n
+	}
+	return s.head
+}
+
+// commitLocked removes the head event, deleting its segment once it is fully replayed.
+func (s *Spool) commitLocked() {
+	if s.head == nil || len(s.segments) == 0 {
+		return
+	}
+	s.head = nil
+	s.segments[0].count--
+	if s.segments[0].count == 0 && len(s.segments) > 1 {
+		s.removeFirstLocked()
+	}
+}
+
+// dropOldestLocked discards the first segment and everything still waiting in it.
+func (s *Spool) dropOldestLocked() {
+	first := s.segments[0]
+	log.Printf("Spool is full, dropping %d events from %s", first.count, first.path)
+	s.dropped += uint64(first.count)
+	s.removeFirstLocked()
+}
+
+// removeFirstLocked deletes the first segment file.
+func (s *Spool) removeFirstLocked() {
+	first := s.segments[0]
+	s.closeReaderLocked()
+	if len(s.segments) == 1 && s.writer != nil {
+		// The writer points at the segment being removed
+		_ = s.writer.Close()
+		s.writer = nil
+	}
+	if err := os.Remove(first.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing spool segment %s: %v", first.path, err)
+	}
+	s.segments = s.segments[1:]
+}
+
+func (s *Spool) closeReaderLocked() {
+	if s.readFile != nil {
+		_ = s.readFile.Close()
+	}
+	s.readFile, s.reader, s.head, s.readOffset = nil, nil, nil, 0
+}
+
+func (s *Spool) newSegmentLocked() (*segment, error) {
+	var seq uint64 = 1
+	if last := s.lastSegmentLocked(); last != nil {
+		seq = last.seq + 1
+	}
+	if s.writer != nil {
+		s.syncLocked()
+		_ = s.writer.Close()
+		s.writer = nil
+	}
+	seg := &segment{seq: seq, path: filepath.Join(s.config.Dir, fmt.Sprintf("%s%020d%s", segmentPrefix, seq, segmentSuffix))}
+	s.segments = append(s.segments, seg)
+	return seg, nil
+}
+
+func (s *Spool) lastSegmentLocked() *segment {
+	if len(s.segments) == 0 {
+		return nil
+	}
+	return s.segments[len(s.segments)-1]
+}
+
+func (s *Spool) depthLocked() int {
+	depth := 0
+	for _, seg := range s.segments {
+		depth += seg.count
+	}
+	return depth
+}
+
+func (s *Spool) bytesLocked() int64 {
+	var size int64
+	for _, seg := range s.segments {
+		size += seg.size
+	}
+	return size
+}
+
+// syncDir flushes the entries of a directory to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// readRecord reads a single spooled event out of the remaining bytes of a segment and returns
+// it with its size on disk.
+func readRecord(reader io.Reader, remaining int64) (*spooledEvent, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, fmt.Errorf("truncated record header")
+		}
+		return nil, 0, err
+	}
+	// A corrupted length must not make us allocate more than the segment could hold
+	length := binary.BigEndian.Uint32(header[8:12])
+	if int64(length) > remaining-recordHeaderSize {
+		return nil, 0, fmt.Errorf("record length %d exceeds the %d remaining bytes", length, remaining-recordHeaderSize)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, 0, fmt.Errorf("truncated record: %w", err)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[12:16]) {
+		return nil, 0, fmt.Errorf("record checksum mismatch")
+	}
+
+	eventMessage := &eventpb.EventMessage{}
+	if err := proto.Unmarshal(payload, eventMessage); err != nil {
+		return nil, 0, fmt.Errorf("could not unmarshal record: %w", err)
+	}
+	spooledAt := time.Unix(0, int64(binary.BigEndian.Uint64(header[0:8])))
+	return &spooledEvent{message: eventMessage, spooledAt: spooledAt}, int64(recordHeaderSize) + int64(length), nil
+}
+
+// SpoolingSink is an EventSink that spools events to disk when another sink cannot deliver
+// them because the hub is unreachable, and replays them in order once it is reachable again.
+// While spooled events are waiting, new events are spooled behind them to preserve ordering.
+type SpoolingSink struct {
+	sink          EventSink
+	spool         *Spool
+	retryInterval time.Duration
+	wake          chan struct{}
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+// NewSpoolingSink wraps sink with spool and starts replaying what the spool already holds.
+func NewSpoolingSink(sink EventSink, spool *Spool) *SpoolingSink {
+	s := &SpoolingSink{
+		sink:          sink,
+		spool:         spool,
+		retryInterval: 10 * time.Second,
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go s.replay()
+	return s
+}
+
+// Send delivers the event, or spools it if earlier events are still spooled or the
+// hub is unreachable. Events the hub rejects are not spooled.
+func (s *SpoolingSink) Send(ctx context.Context, eventMessage *eventpb.EventMessage) error {
+	_, err := s.SendBatch(ctx, []*eventpb.EventMessage{eventMessage})
+	return err
+}
+
+// SendBatch delivers the events, or spools them from the first one the unreachable hub did
+// not take. Spooled events count as delivered; a rejected event stops the batch.
+func (s *SpoolingSink) SendBatch(ctx context.Context, batch []*eventpb.EventMessage) (int, error) {
+	delivered := 0
+	if s.spool.Len() == 0 {
+		n, err := sendBatch(ctx, s.sink, batch)
+		if err == nil || !isRetryable(err) {
+			return n, err
+		}
+		log.Printf("Hub unreachable, spooling events: %v", err)
+		delivered = n
+	}
+
+	defer s.wakeReplay()
+	n, err := s.spool.AppendBatch(batch[delivered:])
+	return delivered + n, err
+}
+
+// wakeReplay lets replay know that events were spooled.
+func (s *SpoolingSink) wakeReplay() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// replay sends spooled events in order, waiting between attempts while the hub is unreachable.
+func (s *SpoolingSink) replay() {
+	defer close(s.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.stop
+		cancel()
+	}()
+
+	for {
+		eventMessage, ok := s.spool.Peek()
+		if !ok {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.stop:
+				return
+			}
+		}
+
+		err := s.sink.Send(ctx, eventMessage)
+		switch {
+		case err == nil:
+			s.spool.Commit()
+			if s.spool.Len() == 0 {
+				log.Printf("Spooled events replayed")
+			}
+			continue
+		case !isRetryable(err):
+			log.Printf("Hub rejected spooled event %s/%s, dropping it: %v", eventMessage.Namespace, eventMessage.ResourceKey, err)
+			s.spool.Commit()
+			continue
+		}
+
+		select {
+		case <-time.After(s.retryInterval):
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Stats returns the current counters of the spool.
+func (s *SpoolingSink) Stats() SpoolStats {
+	return s.spool.Stats()
+}
+
+// Close stops replaying, keeping unreplayed events on disk, and closes the underlying sink.
+func (s *SpoolingSink) Close() error {
+	close(s.stop)
+	<-s.done
+	if err := s.spool.Close(); err != nil {
+		log.Printf("Error closing spool: %v", err)
+	}
+	return s.sink.Close()
+}
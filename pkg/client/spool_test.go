@@ -0,0 +1,194 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+func openTestSpool(t *testing.T, config SpoolConfig) *Spool {
+	t.Helper()
+	spool, err := OpenSpool(config)
+	if err != nil {
+		t.Fatalf("OpenSpool failed: %v", err)
+	}
+	return spool
+}
+
+func appendEvents(t *testing.T, spool *Spool, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		if err := spool.Append(&eventpb.EventMessage{ResourceKey: key, Data: make([]byte, 100)}); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+}
+
+// drainSpool peeks and commits every event, returning their keys in order.
+func drainSpool(spool *Spool) []string {
+	var keys []string
+	for {
+		eventMessage, ok := spool.Peek()
+		if !ok {
+			return keys
+		}
+		keys = append(keys, eventMessage.ResourceKey)
+		spool.Commit()
+	}
+}
+
+func TestSpoolOrderAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	spool := openTestSpool(t, SpoolConfig{Dir: dir, MaxBytes: 1 << 20, MaxAge: time.Hour, SegmentBytes: 300})
+
+	appendEvents(t, spool, "a", "b", "c", "d", "e")
+	if stats := spool.Stats(); stats.Depth != 5 || stats.OldestAge <= 0 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) < 2 {
+		t.Fatalf("Expected events to be spread over several segments, got %d", len(entries))
+	}
+
+	if got := fmt.Sprint(drainSpool(spool)); got != "[a b c d e]" {
+		t.Fatalf("Expected events in order, got %s", got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 1 {
+		t.Fatalf("Expected replayed segments to be deleted, got %d left", len(entries))
+	}
+}
+
+func TestSpoolReopen(t *testing.T) {
+	dir := t.TempDir()
+	config := SpoolConfig{Dir: dir, MaxBytes: 1 << 20, MaxAge: time.Hour, SegmentBytes: 300}
+	spool := openTestSpool(t, config)
+	appendEvents(t, spool, "a", "b", "c")
+	_ = spool.Close()
+
+	// A truncated record at the end of a segment, e.g. from a crash mid-write, is ignored
+	entries, _ := os.ReadDir(dir)
+	f, _ := os.OpenFile(dir+"/"+entries[len(entries)-1].Name(), os.O_WRONLY|os.O_APPEND, 0o600)
+	_, _ = f.Write([]byte{0, 1, 2})
+	_ = f.Close()
+
+	spool = openTestSpool(t, config)
+	defer spool.Close()
+	appendEvents(t, spool, "d")
+
+	if got := fmt.Sprint(drainSpool(spool)); got != "[a b c d]" {
+		t.Fatalf("Expected events of the previous run to be replayed first, got %s", got)
+	}
+}
+
+func TestSpoolCorruptedLength(t *testing.T) {
+	dir := t.TempDir()
+	config := SpoolConfig{Dir: dir, MaxBytes: 1 << 20, MaxAge: time.Hour, Sync: SyncPerEvent}
+	spool := openTestSpool(t, config)
+	if n, err := spool.AppendBatch([]*eventpb.EventMessage{{ResourceKey: "a"}, {ResourceKey: "b"}}); n != 2 || err != nil {
+		t.Fatalf("Expected 2 events to be spooled, got %d and %v", n, err)
+	}
+	_ = spool.Close()
+
+	// The length in the header of b claims 4 GiB
+	entries, _ := os.ReadDir(dir)
+	path := dir + "/" + entries[0].Name()
+	data, _ := os.ReadFile(path)
+	second := recordHeaderSize + int(binary.BigEndian.Uint32(data[8:12]))
+	binary.BigEndian.PutUint32(data[second+8:second+12], 0xffffffff)
+	_ = os.WriteFile(path, data, 0o600)
+
+	spool = openTestSpool(t, config)
+	defer spool.Close()
+	if got := fmt.Sprint(drainSpool(spool)); got != "[a]" {
+		t.Fatalf("Expected the events before the corrupted record to be replayed, got %s", got)
+	}
+}
+
+func TestSpoolBounds(t *testing.T) {
+	spool := openTestSpool(t, SpoolConfig{Dir: t.TempDir(), MaxBytes: 600, MaxAge: time.Hour, SegmentBytes: 200})
+	defer spool.Close()
+
+	// Each event takes about 120 bytes, so the oldest segments are dropped to stay under 600
+	appendEvents(t, spool, "a", "b", "c", "d", "e", "f", "g")
+	stats := spool.Stats()
+	if stats.Bytes > 600 || stats.Dropped == 0 {
+		t.Fatalf("Expected the spool to stay within its size bound, got %+v", stats)
+	}
+	if got := drainSpool(spool); got[len(got)-1] != "g" || len(got) != 7-int(stats.Dropped) {
+		t.Fatalf("Expected the newest events to be kept, got %v", got)
+	}
+
+	spool.config.MaxAge = time.Nanosecond
+	appendEvents(t, spool, "h")
+	time.Sleep(time.Millisecond)
+	if _, ok := spool.Peek(); ok {
+		t.Fatal("Expected events older than the age bound to be dropped")
+	}
+}
+
+// flakySink fails with Unavailable until the hub is brought up, then records events.
+type flakySink struct {
+	recordingSink
+	up atomic.Bool
+}
+
+func (s *flakySink) Send(ctx context.Context, eventMessage *eventpb.EventMessage) error {
+	if !s.up.Load() {
+		return status.Error(codes.Unavailable, "hub down")
+	}
+	return s.recordingSink.Send(ctx, eventMessage)
+}
+
+func (s *flakySink) setUp() {
+	s.up.Store(true)
+}
+
+func TestSpoolingSink(t *testing.T) {
+	inner := &flakySink{}
+	spool := openTestSpool(t, SpoolConfig{Dir: t.TempDir(), MaxBytes: 1 << 20, MaxAge: time.Hour})
+	sink := NewSpoolingSink(inner, spool)
+	sink.retryInterval = 10 * time.Millisecond
+	defer sink.Close()
+
+	batch := []*eventpb.EventMessage{{ResourceKey: "a"}, {ResourceKey: "b"}}
+	if n, err := sink.SendBatch(context.Background(), batch); n != 2 || err != nil {
+		t.Fatalf("Expected the events to be spooled, got %d and %v", n, err)
+	}
+	if stats := sink.Stats(); stats.Depth != 2 {
+		t.Fatalf("Expected 2 spooled events, got %+v", stats)
+	}
+
+	inner.setUp()
+	// New events queue behind the spooled ones
+	_ = sink.Send(context.Background(), &eventpb.EventMessage{ResourceKey: "c"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(inner.keys()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := fmt.Sprint(inner.keys()); got != "[a b c]" {
+		t.Fatalf("Expected spooled events to be replayed in order, got %s", got)
+	}
+}
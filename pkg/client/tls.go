@@ -0,0 +1,139 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TLSConfig configures the TLS connection to the hub.
+type TLSConfig struct {
+	// Enabled turns TLS on; without it the connection is not encrypted.
+	Enabled bool
+	// CAFile is a PEM bundle of the CAs trusted to sign the hub's certificate.
+	// The system roots are trusted when unset.
+	CAFile string
+	// CertFile and KeyFile are the PEM client certificate and key presented to the hub.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name the hub's certificate is verified against.
+	ServerName string
+	// MinVersion is the minimum TLS version accepted.
+	MinVersion uint16
+}
+
+// TLSConfigFromEnv reads the TLS configuration from USE_TLS, TLS_CA_FILE, TLS_CERT_FILE,
+// TLS_KEY_FILE, TLS_SERVER_NAME and TLS_MIN_VERSION ("1.2" or "1.3", defaulting to 1.2).
+func TLSConfigFromEnv() (TLSConfig, error) {
+	config := TLSConfig{
+		Enabled:    os.Getenv("USE_TLS") == "true",
+		CAFile:     os.Getenv("TLS_CA_FILE"),
+		CertFile:   os.Getenv("TLS_CERT_FILE"),
+		KeyFile:    os.Getenv("TLS_KEY_FILE"),
+		ServerName: os.Getenv("TLS_SERVER_NAME"),
+		MinVersion: tls.VersionTLS12,
+	}
+	switch version := os.Getenv("TLS_MIN_VERSION"); version {
+	case "", "1.2":
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return TLSConfig{}, fmt.Errorf("unsupported TLS_MIN_VERSION %q, expected 1.2 or 1.3", version)
+	}
+	if !config.Enabled && (config.CAFile != "" || config.CertFile != "") {
+		return TLSConfig{}, errors.New("TLS_CA_FILE and TLS_CERT_FILE require USE_TLS=true")
+	}
+	return config, nil
+}
+
+// clientConfig builds the tls.Config for the hub connection. The CA bundle and the client
+// certificate are read again on every handshake, so certificates rotated on disk, e.g.
+// by cert-manager, are used as soon as the connection is re-established.
+func (c TLSConfig) clientConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: c.MinVersion,
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("a client certificate needs both a certificate and a key file")
+		}
+		// Fail at startup rather than on the first handshake
+		if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not load client certificate: %w", err)
+			}
+			return &cert, nil
+		}
+	}
+
+	if c.CAFile != "" {
+		if _, err := loadCertPool(c.CAFile); err != nil {
+			return nil, err
+		}
+		// The default verification uses a fixed pool, so the hub's certificate is verified
+		// in VerifyConnection against the current bundle instead
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPeer(state, c.CAFile)
+		}
+	}
+
+	return config, nil
+}
+
+// verifyPeer verifies the certificate chain presented by the hub against the CAs in caFile.
+func verifyPeer(state tls.ConnectionState, caFile string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("hub did not present a certificate")
+	}
+	roots, err := loadCertPool(caFile)
+	if err != nil {
+		return err
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       state.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// loadCertPool reads a PEM bundle of CA certificates.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", caFile)
+	}
+	return pool, nil
+}
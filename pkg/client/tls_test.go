@@ -0,0 +1,227 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for name, usable by a server and a client.
+func (ca *testCA) issue(t *testing.T, name string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// startTLSServer accepts connections from clients with a certificate signed by clientCA
+// and reports the result of every handshake.
+func startTLSServer(t *testing.T, serverCA, clientCA *testCA) (string, <-chan error) {
+	t.Helper()
+	certPEM, keyPEM := serverCA.issue(t, "hub.example")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Failed to load server certificate: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.cert)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	handshakes := make(chan error, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			handshakes <- conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), handshakes
+}
+
+// handshake connects to addr and returns the error seen by the client or the server.
+func handshake(t *testing.T, addr string, config *tls.Config, handshakes <-chan error) error {
+	t.Helper()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, config)
+	if err == nil {
+		conn.Close()
+	}
+	select {
+	case serverErr := <-handshakes:
+		if err == nil {
+			err = serverErr
+		}
+	case <-time.After(5 * time.Second):
+		if err == nil {
+			t.Fatal("Timed out waiting for the server handshake")
+		}
+	}
+	return err
+}
+
+func TestTLSClientConfig(t *testing.T) {
+	hubCA, agentCA, otherCA := newTestCA(t, "hub-ca"), newTestCA(t, "agent-ca"), newTestCA(t, "other-ca")
+	addr, handshakes := startTLSServer(t, hubCA, agentCA)
+
+	dir := t.TempDir()
+	config := TLSConfig{
+		Enabled:    true,
+		CAFile:     filepath.Join(dir, "ca.crt"),
+		CertFile:   filepath.Join(dir, "tls.crt"),
+		KeyFile:    filepath.Join(dir, "tls.key"),
+		ServerName: "hub.example",
+		MinVersion: tls.VersionTLS12,
+	}
+	writeFile(t, config.CAFile, hubCA.pem)
+	certPEM, keyPEM := agentCA.issue(t, "agent")
+	writeFile(t, config.CertFile, certPEM)
+	writeFile(t, config.KeyFile, keyPEM)
+
+	clientConfig, err := config.clientConfig()
+	if err != nil {
+		t.Fatalf("Failed to build TLS config: %v", err)
+	}
+	if err := handshake(t, addr, clientConfig, handshakes); err != nil {
+		t.Fatalf("Expected mutual TLS to succeed: %v", err)
+	}
+
+	// Rotated certificates are used by the next handshake without rebuilding the config
+	certPEM, keyPEM = otherCA.issue(t, "agent")
+	writeFile(t, config.CertFile, certPEM)
+	writeFile(t, config.KeyFile, keyPEM)
+	if err := handshake(t, addr, clientConfig, handshakes); err == nil {
+		t.Fatal("Expected a client certificate from an untrusted CA to be rejected")
+	}
+
+	certPEM, keyPEM = agentCA.issue(t, "agent")
+	writeFile(t, config.CertFile, certPEM)
+	writeFile(t, config.KeyFile, keyPEM)
+	writeFile(t, config.CAFile, otherCA.pem)
+	if err := handshake(t, addr, clientConfig, handshakes); err == nil {
+		t.Fatal("Expected the hub to be rejected once its CA is no longer trusted")
+	}
+
+	// The server name must match the hub's certificate
+	writeFile(t, config.CAFile, hubCA.pem)
+	config.ServerName = "other.example"
+	clientConfig, err = config.clientConfig()
+	if err != nil {
+		t.Fatalf("Failed to build TLS config: %v", err)
+	}
+	if err := handshake(t, addr, clientConfig, handshakes); err == nil {
+		t.Fatal("Expected a certificate for another name to be rejected")
+	}
+}
+
+func TestTLSConfigFromEnv(t *testing.T) {
+	t.Setenv("USE_TLS", "true")
+	t.Setenv("TLS_MIN_VERSION", "1.3")
+	config, err := TLSConfigFromEnv()
+	if err != nil || !config.Enabled || config.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("Expected TLS 1.3 to be required, got %+v, %v", config, err)
+	}
+
+	t.Setenv("TLS_MIN_VERSION", "1.0")
+	if _, err := TLSConfigFromEnv(); err == nil {
+		t.Fatal("Expected TLS 1.0 to be rejected")
+	}
+
+	t.Setenv("TLS_MIN_VERSION", "")
+	t.Setenv("USE_TLS", "false")
+	t.Setenv("TLS_CA_FILE", "/etc/hub/ca.crt")
+	if _, err := TLSConfigFromEnv(); err == nil {
+		t.Fatal("Expected a CA bundle without USE_TLS to be rejected")
+	}
+}
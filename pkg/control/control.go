@@ -0,0 +1,216 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package control executes commands sent by the central hub over the Connect stream.
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/incidentassistant/k8s-agent/pkg/handler"
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+const (
+	// commandTimeout bounds how long a single command may take
+	commandTimeout = 30 * time.Second
+
+	// minReconnectDelay and maxReconnectDelay bound the wait before reopening a broken stream
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+// Executor runs hub commands against the object cache and the API server.
+type Executor struct {
+	client dynamic.Interface
+}
+
+// NewExecutor creates an executor reading live objects through client.
+func NewExecutor(client dynamic.Interface) *Executor {
+	return &Executor{client: client}
+}
+
+// Execute runs a command and returns its result. Failures are reported in the result.
+func (e *Executor) Execute(ctx context.Context, command *eventpb.HubCommand) *eventpb.CommandResult {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+
+	result := &eventpb.CommandResult{CommandId: command.CommandId}
+	objects, err := e.execute(ctx, command)
+	if err != nil {
+		log.Printf("Hub command %s failed: %v", command.CommandId, err)
+		result.Error = err.Error()
+		return result
+	}
+	result.Success = true
+	result.Objects = objects
+	return result
+}
+
+func (e *Executor) execute(ctx context.Context, command *eventpb.HubCommand) ([][]byte, error) {
+	switch c := command.Command.(type) {
+	case *eventpb.HubCommand_GetResource:
+		return e.getResource(ctx, c.GetResource)
+	case *eventpb.HubCommand_GetNamespace:
+		if c.GetNamespace.Namespace == "" {
+			return nil, fmt.Errorf("namespace is required")
+		}
+		return encodeObjects(handler.NamespaceObjects(c.GetNamespace.Namespace))
+	case *eventpb.HubCommand_SetLogLevel:
+		switch c.SetLogLevel.Level {
+		case "debug":
+			handler.SetDebug(true)
+		case "info":
+			handler.SetDebug(false)
+		default:
+			return nil, fmt.Errorf("unknown log level %q", c.SetLogLevel.Level)
+		}
+		log.Printf("Log level set to %s by the hub", c.SetLogLevel.Level)
+		return nil, nil
+	case *eventpb.HubCommand_PauseEmission:
+		handler.SetEmissionPaused(true)
+		log.Printf("Event emission paused by the hub")
+		return nil, nil
+	case *eventpb.HubCommand_ResumeEmission:
+		handler.SetEmissionPaused(false)
+		log.Printf("Event emission resumed by the hub")
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported command %T", command.Command)
+	}
+}
+
+// getResource reads an object, or every object of a resource in a namespace, from the API server.
+func (e *Executor) getResource(ctx context.Context, request *eventpb.GetResource) ([][]byte, error) {
+	if request.Version == "" || request.Resource == "" {
+		return nil, fmt.Errorf("version and resource are required")
+	}
+	gvr := schema.GroupVersionResource{Group: request.Group, Version: request.Version, Resource: request.Resource}
+	resourceClient := e.client.Resource(gvr).Namespace(request.Namespace)
+
+	var items []unstructured.Unstructured
+	if request.Name != "" {
+		obj, err := resourceClient.Get(ctx, request.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *obj)
+	} else {
+		list, err := resourceClient.List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		items = list.Items
+	}
+
+	// Live objects are redacted like the ones the agent reports in events
+	objects := make([]runtime.Object, 0, len(items))
+	for i := range items {
+		redacted, err := handler.Redact(&items[i], gvr)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, redacted)
+	}
+	return encodeObjects(objects)
+}
+
+// encodeObjects encodes objects as JSON, trimmed like the objects of events.
+func encodeObjects(objects []runtime.Object) ([][]byte, error) {
+	encoded := make([][]byte, 0, len(objects))
+	for _, obj := range objects {
+		u, ok := obj.(runtime.Unstructured)
+		if !ok {
+			content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+			if err != nil {
+				return nil, err
+			}
+			u = &unstructured.Unstructured{Object: content}
+		}
+
+		// Trimming copies the object, so cached objects are left untouched
+		data, err := json.Marshal(handler.TrimObject(u))
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, data)
+	}
+	return encoded, nil
+}
+
+// Run keeps a control stream open to the hub on conn and answers the commands it receives
+// until ctx is cancelled. Broken streams are reopened with exponential backoff; if the hub
+// does not implement Connect, Run returns.
+func Run(ctx context.Context, conn grpc.ClientConnInterface, executor *Executor) {
+	client := eventpb.NewEventServiceClient(conn)
+	delay := minReconnectDelay
+	for {
+		received, err := serve(ctx, client, executor)
+		if ctx.Err() != nil {
+			return
+		}
+		if status.Code(err) == codes.Unimplemented {
+			log.Printf("Hub does not support Connect, control stream disabled")
+			return
+		}
+		if received {
+			delay = minReconnectDelay
+		}
+
+		log.Printf("Control stream closed, reconnecting in %s: %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+}
+
+// serve answers commands on a single stream until it breaks, and reports whether any command was received.
+func serve(ctx context.Context, client eventpb.EventServiceClient, executor *Executor) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := client.Connect(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	received := false
+	for {
+		command, err := stream.Recv()
+		if err != nil {
+			return received, err
+		}
+		received = true
+
+		if err := stream.Send(executor.Execute(ctx, command)); err != nil {
+			return received, err
+		}
+	}
+}
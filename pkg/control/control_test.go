@@ -0,0 +1,221 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/incidentassistant/k8s-agent/pkg/handler"
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+var configMaps = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+func newConfigMap(namespace, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	obj.SetAnnotations(map[string]string{"kubectl.kubernetes.io/last-applied-configuration": "{}"})
+	return obj
+}
+
+func newExecutor(objects ...runtime.Object) *Executor {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{configMaps: "ConfigMapList"}, objects...)
+	return NewExecutor(client)
+}
+
+// decodeNames returns the names of the objects in a command result.
+func decodeNames(t *testing.T, result *eventpb.CommandResult) []string {
+	t.Helper()
+	var names []string
+	for _, data := range result.Objects {
+		var obj unstructured.Unstructured
+		if err := json.Unmarshal(data, &obj.Object); err != nil {
+			t.Fatalf("Failed to decode object: %v", err)
+		}
+		if _, found := obj.GetAnnotations()["kubectl.kubernetes.io/last-applied-configuration"]; found {
+			t.Fatalf("Expected the last applied configuration to be removed from %s", obj.GetName())
+		}
+		names = append(names, obj.GetName())
+	}
+	return names
+}
+
+func TestExecuteGetResource(t *testing.T) {
+	executor := newExecutor(newConfigMap("default", "a"), newConfigMap("default", "b"), newConfigMap("other", "c"))
+
+	result := executor.Execute(context.Background(), &eventpb.HubCommand{
+		CommandId: "1",
+		Command: &eventpb.HubCommand_GetResource{GetResource: &eventpb.GetResource{
+			Version: "v1", Resource: "configmaps", Namespace: "default", Name: "b",
+		}},
+	})
+	if !result.Success || result.CommandId != "1" {
+		t.Fatalf("Expected command 1 to succeed, got %+v", result)
+	}
+	if names := decodeNames(t, result); len(names) != 1 || names[0] != "b" {
+		t.Fatalf("Expected config map b, got %v", names)
+	}
+
+	// Without a name every object in the namespace is returned
+	result = executor.Execute(context.Background(), &eventpb.HubCommand{
+		Command: &eventpb.HubCommand_GetResource{GetResource: &eventpb.GetResource{
+			Version: "v1", Resource: "configmaps", Namespace: "default",
+		}},
+	})
+	if names := decodeNames(t, result); len(names) != 2 {
+		t.Fatalf("Expected two config maps, got %v", names)
+	}
+
+	result = executor.Execute(context.Background(), &eventpb.HubCommand{
+		Command: &eventpb.HubCommand_GetResource{GetResource: &eventpb.GetResource{
+			Version: "v1", Resource: "configmaps", Namespace: "default", Name: "missing",
+		}},
+	})
+	if result.Success || result.Error == "" {
+		t.Fatalf("Expected a missing object to fail, got %+v", result)
+	}
+}
+
+func TestExecuteGetNamespace(t *testing.T) {
+	handler.Seed(newConfigMap("control-test", "cached"), configMaps)
+
+	result := newExecutor().Execute(context.Background(), &eventpb.HubCommand{
+		Command: &eventpb.HubCommand_GetNamespace{GetNamespace: &eventpb.GetNamespace{Namespace: "control-test"}},
+	})
+	if names := decodeNames(t, result); len(names) != 1 || names[0] != "cached" {
+		t.Fatalf("Expected the cached config map, got %v", names)
+	}
+}
+
+func TestExecuteSetLogLevel(t *testing.T) {
+	executor := newExecutor()
+	defer handler.SetDebug(false)
+
+	for level, success := range map[string]bool{"debug": true, "info": true, "verbose": false} {
+		result := executor.Execute(context.Background(), &eventpb.HubCommand{
+			Command: &eventpb.HubCommand_SetLogLevel{SetLogLevel: &eventpb.SetLogLevel{Level: level}},
+		})
+		if result.Success != success {
+			t.Errorf("Expected level %q to succeed: %v, got %+v", level, success, result)
+		}
+	}
+}
+
+// commandServer sends its commands on the first Connect stream and collects the results.
+type commandServer struct {
+	eventpb.UnimplementedEventServiceServer
+	commands []*eventpb.HubCommand
+	results  chan *eventpb.CommandResult
+}
+
+func (s *commandServer) Connect(stream eventpb.EventService_ConnectServer) error {
+	for _, command := range s.commands {
+		if err := stream.Send(command); err != nil {
+			return err
+		}
+		result, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		s.results <- result
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+// dialServer starts srv on an in-memory listener and returns a connection to it.
+func dialServer(t *testing.T, srv eventpb.EventServiceServer) *grpc.ClientConn {
+	t.Helper()
+	listener := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	eventpb.RegisterEventServiceServer(s, srv)
+	go func() { _ = s.Serve(listener) }()
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial bufnet: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestRun(t *testing.T) {
+	srv := &commandServer{
+		commands: []*eventpb.HubCommand{
+			{CommandId: "pause", Command: &eventpb.HubCommand_PauseEmission{PauseEmission: &eventpb.PauseEmission{}}},
+			{CommandId: "resume", Command: &eventpb.HubCommand_ResumeEmission{ResumeEmission: &eventpb.ResumeEmission{}}},
+		},
+		results: make(chan *eventpb.CommandResult, 2),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Run(ctx, dialServer(t, srv), newExecutor())
+		close(done)
+	}()
+
+	for _, id := range []string{"pause", "resume"} {
+		select {
+		case result := <-srv.results:
+			if result.CommandId != id || !result.Success {
+				t.Fatalf("Expected command %s to succeed, got %+v", id, result)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the result of %s", id)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return once its context is cancelled")
+	}
+}
+
+func TestRunUnimplemented(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		Run(context.Background(), dialServer(t, &eventpb.UnimplementedEventServiceServer{}), newExecutor())
+		close(done)
+	}()
+
+	// A hub without Connect disables the control stream instead of reconnecting forever
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to give up on a hub without Connect")
+	}
+}
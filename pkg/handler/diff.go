@@ -0,0 +1,360 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+)
+
+// Operations of a fieldDiff.
+const (
+	opAdd     = "add"
+	opRemove  = "remove"
+	opReplace = "replace"
+	opMove    = "move"
+)
+
+// mergeKeys are the fields identifying the elements of well-known lists, by list name, in
+// order of preference. The elements of these lists are matched by identity rather than by
+// position, so that inserting, removing or reordering an element does not show up as a change
+// of every element after it. A key is only used if every element of both lists has a
+// distinct value for it.
+var mergeKeys = map[string][]string{
+	"containers":            {"name"},
+	"initContainers":        {"name"},
+	"ephemeralContainers":   {"name"},
+	"containerStatuses":     {"name"},
+	"initContainerStatuses": {"name"},
+	"env":                   {"name"},
+	"ports":                 {"containerPort", "port"},
+	"volumes":               {"name"},
+	"volumeMounts":          {"mountPath"},
+	"imagePullSecrets":      {"name"},
+	"conditions":            {"type"},
+}
+
+// reorderedLists holds the names of the keyed lists, read from REORDER_EVENT_LISTS, whose
+// reorders are reported on their own. Order matters in some lists, e.g. init containers run in
+// order and environment variables can only refer to the ones before them, but controllers and
+// Helm also shuffle them without meaning anything, so by default a reorder alone is no change.
+var reorderedLists = newReorderedLists(os.Getenv("REORDER_EVENT_LISTS"))
+
+// newReorderedLists parses comma-separated list names, such as "initContainers,env".
+func newReorderedLists(names string) map[string]bool {
+	lists := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			lists[name] = true
+		}
+	}
+	return lists
+}
+
+// onlyReorders reports whether the diffs only move elements of keyed lists whose reorders are
+// not reported on their own. Moves that come with other changes are always reported.
+func onlyReorders(diffs []fieldDiff) bool {
+	if len(diffs) == 0 {
+		return false
+	}
+	for _, diff := range diffs {
+		if diff.op != opMove {
+			return false
+		}
+		// The path of a moved element ends with the list name and its position
+		segments := splitPointer(diff.path)
+		if len(segments) < 2 || reorderedLists[segments[len(segments)-2]] {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldDiff is a single change between two versions of an object.
+type fieldDiff struct {
+	op   string
+	path string // JSON pointer to the field in the new object, or in the old object when removed
+	from string // JSON pointer to the field in the old object when moved
+	// identity is the path with the elements of keyed lists written as key=value, e.g.
+	// /spec/containers/name=app/image, set if the field is in a keyed list.
+	identity string
+	oldValue interface{}
+	newValue interface{}
+}
+
+// key returns the key of the change in the changes map of an event: its identity if it is in
+// a keyed list, where the path of a removed element may also be that of another element, or
+// else its path.
+func (d fieldDiff) key() string {
+	return changeKey(d.path, d.identity)
+}
+
+// changeKey returns the key of the change of a field with the given path and identity.
+func changeKey(path, identity string) string {
+	if identity != "" {
+		return identity
+	}
+	return path
+}
+
+// entry returns the change as reported in the changes map of an event.
+func (d fieldDiff) entry() map[string]interface{} {
+	entry := map[string]interface{}{
+		"op":  d.op,
+		"old": d.oldValue,
+		"new": d.newValue,
+	}
+	if d.from != "" {
+		entry["from"] = d.from
+	}
+	if d.identity != "" {
+		// The change is keyed by its identity
+		entry["identity"] = d.identity
+		entry["path"] = d.path
+	}
+	return entry
+}
+
+// diffObjects returns the changes between two versions of an object, sorted by path within
+// every map and by position within every list.
+func diffObjects(oldObj, newObj k8sruntime.Object) ([]fieldDiff, error) {
+	oldValue, err := toJSONValue(oldObj)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal old object: %w", err)
+	}
+	newValue, err := toJSONValue(newObj)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal new object: %w", err)
+	}
+
+	var d differ
+	d.diff(nil, nil, oldValue, newValue)
+	return d.diffs, nil
+}
+
+// toJSONValue returns the object as decoded from its JSON encoding, so typed and unstructured
+// objects are compared alike.
+func toJSONValue(obj k8sruntime.Object) (interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	err = json.Unmarshal(data, &value)
+	return value, err
+}
+
+// differ collects the changes found while walking two values side by side. The path holds the
+// unescaped segments of the current field and the identity the same segments with the
+// positions in keyed lists replaced by the identity of the element.
+type differ struct {
+	diffs []fieldDiff
+}
+
+func (d *differ) record(op string, path, identity []string, oldValue, newValue interface{}) {
+	diff := fieldDiff{op: op, path: joinPointer(path), oldValue: oldValue, newValue: newValue}
+	if id := joinPointer(identity); id != diff.path {
+		diff.identity = id
+	}
+	d.diffs = append(d.diffs, diff)
+}
+
+func (d *differ) diff(path, identity []string, oldValue, newValue interface{}) {
+	switch o := oldValue.(type) {
+	case map[string]interface{}:
+		if n, ok := newValue.(map[string]interface{}); ok {
+			d.diffMaps(path, identity, o, n)
+			return
+		}
+	case []interface{}:
+		if n, ok := newValue.([]interface{}); ok {
+			d.diffLists(path, identity, o, n)
+			return
+		}
+	}
+	if !reflect.DeepEqual(oldValue, newValue) {
+		d.record(opReplace, path, identity, oldValue, newValue)
+	}
+}
+
+func (d *differ) diffMaps(path, identity []string, o, n map[string]interface{}) {
+	keys := make([]string, 0, len(o)+len(n))
+	for key := range o {
+		keys = append(keys, key)
+	}
+	for key := range n {
+		if _, found := o[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		oldValue, inOld := o[key]
+		newValue, inNew := n[key]
+		fieldPath, fieldIdentity := appendSegment(path, key), appendSegment(identity, key)
+		switch {
+		case !inNew:
+			d.record(opRemove, fieldPath, fieldIdentity, oldValue, nil)
+		case !inOld:
+			d.record(opAdd, fieldPath, fieldIdentity, nil, newValue)
+		default:
+			d.diff(fieldPath, fieldIdentity, oldValue, newValue)
+		}
+	}
+}
+
+func (d *differ) diffLists(path, identity []string, o, n []interface{}) {
+	if len(path) > 0 {
+		if key := mergeKey(path[len(path)-1], o, n); key != "" {
+			d.diffKeyedLists(path, identity, key, o, n)
+			return
+		}
+	}
+
+	for i := 0; i < len(o) || i < len(n); i++ {
+		elementPath, elementIdentity := appendSegment(path, strconv.Itoa(i)), appendSegment(identity, strconv.Itoa(i))
+		switch {
+		case i >= len(n):
+			d.record(opRemove, elementPath, elementIdentity, o[i], nil)
+		case i >= len(o):
+			d.record(opAdd, elementPath, elementIdentity, nil, n[i])
+		default:
+			d.diff(elementPath, elementIdentity, o[i], n[i])
+		}
+	}
+}
+
+// diffKeyedLists matches the elements of two lists by the value of their merge key. Elements
+// are added, removed or changed in place, and moved only if their order relative to the
+// other elements changed, so that an insertion does not move every element after it. A
+// removed element is reported at its old position even if another element takes it.
+func (d *differ) diffKeyedLists(path, identity []string, key string, o, n []interface{}) {
+	oldPositions := make(map[string]int, len(o))
+	for i, element := range o {
+		oldPositions[elementKey(element, key)] = i
+	}
+	var kept [][2]int
+	newKeys := make(map[string]bool, len(n))
+	for j, element := range n {
+		newKeys[elementKey(element, key)] = true
+		if i, found := oldPositions[elementKey(element, key)]; found {
+			kept = append(kept, [2]int{i, j})
+		}
+	}
+	removed := make(map[int]bool)
+	for i, element := range o {
+		if !newKeys[elementKey(element, key)] {
+			removed[i] = true
+		}
+	}
+	moved := movedElements(kept)
+
+	for j, element := range n {
+		id := elementKey(element, key)
+		elementPath, elementIdentity := appendSegment(path, strconv.Itoa(j)), appendSegment(identity, key+"="+id)
+		i, inOld := oldPositions[id]
+		if !inOld {
+			d.record(opAdd, elementPath, elementIdentity, nil, element)
+			continue
+		}
+		if moved[j] {
+			d.diffs = append(d.diffs, fieldDiff{
+				op:       opMove,
+				path:     joinPointer(elementPath),
+				from:     joinPointer(appendSegment(path, strconv.Itoa(i))),
+				identity: joinPointer(elementIdentity),
+			})
+		}
+		d.diff(elementPath, elementIdentity, o[i], element)
+	}
+
+	for i, element := range o {
+		if removed[i] {
+			d.record(opRemove, appendSegment(path, strconv.Itoa(i)), appendSegment(identity, key+"="+elementKey(element, key)), element, nil)
+		}
+	}
+}
+
+// mergeKey returns the key identifying the elements of a list with the given name, or "" if
+// the list is not keyed or its elements cannot be told apart by the key.
+func mergeKey(name string, lists ...[]interface{}) string {
+	for _, key := range mergeKeys[name] {
+		if hasDistinctKeys(key, lists...) {
+			return key
+		}
+	}
+	return ""
+}
+
+func hasDistinctKeys(key string, lists ...[]interface{}) bool {
+	for _, list := range lists {
+		seen := make(map[string]bool, len(list))
+		for _, element := range list {
+			fields, ok := element.(map[string]interface{})
+			if !ok || fields[key] == nil || seen[elementKey(element, key)] {
+				return false
+			}
+			seen[elementKey(element, key)] = true
+		}
+	}
+	return true
+}
+
+// elementKey returns the value of the merge key of a list element as a string.
+func elementKey(element interface{}, key string) string {
+	fields, _ := element.(map[string]interface{})
+	return fmt.Sprint(fields[key])
+}
+
+// movedElements returns the new positions of the kept elements that moved, given the old and
+// new position of every kept element in their new order. The longest run of elements that
+// kept their relative order stays in place, and every other element is moved.
+func movedElements(kept [][2]int) map[int]bool {
+	// length[k] is the length of the longest increasing run of old positions ending at k
+	length := make([]int, len(kept))
+	previous := make([]int, len(kept))
+	last := -1
+	for k := range kept {
+		length[k], previous[k] = 1, -1
+		for l := 0; l < k; l++ {
+			if kept[l][0] < kept[k][0] && length[l]+1 > length[k] {
+				length[k], previous[k] = length[l]+1, l
+			}
+		}
+		if last < 0 || length[k] > length[last] {
+			last = k
+		}
+	}
+
+	inPlace := make(map[int]bool, len(kept))
+	for k := last; k >= 0; k = previous[k] {
+		inPlace[k] = true
+	}
+	moved := make(map[int]bool)
+	for k, positions := range kept {
+		if !inPlace[k] {
+			moved[positions[1]] = true
+		}
+	}
+	return moved
+}
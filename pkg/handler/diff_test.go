@@ -0,0 +1,225 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+func newPod(containers ...corev1.Container) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+		Spec:       corev1.PodSpec{Containers: containers},
+	}
+}
+
+// diffPaths returns the operation of every change by path.
+func diffPaths(t *testing.T, oldPod, newPod *corev1.Pod) map[string]fieldDiff {
+	t.Helper()
+	diffs, err := diffObjects(oldPod, newPod)
+	if err != nil {
+		t.Fatalf("diffObjects failed: %v", err)
+	}
+	byPath := make(map[string]fieldDiff, len(diffs))
+	for _, diff := range diffs {
+		byPath[diff.path] = diff
+	}
+	return byPath
+}
+
+func TestDiffObjectsAddsAndRemovesListElements(t *testing.T) {
+	app := corev1.Container{Name: "app", Image: "app:1", Env: []corev1.EnvVar{{Name: "A", Value: "1"}, {Name: "B", Value: "2"}}}
+	sidecar := corev1.Container{Name: "sidecar", Image: "proxy:1"}
+
+	// Inserting a container in front does not change or move the following one
+	updatedApp := *app.DeepCopy()
+	updatedApp.Env = updatedApp.Env[1:]
+	diffs := diffPaths(t, newPod(app), newPod(sidecar, updatedApp))
+	assert.Len(t, diffs, 2)
+	assert.Equal(t, opAdd, diffs["/spec/containers/0"].op)
+	assert.Equal(t, "/spec/containers/name=sidecar", diffs["/spec/containers/0"].identity)
+	assert.Equal(t, map[string]interface{}{"name": "sidecar", "image": "proxy:1", "resources": map[string]interface{}{}}, diffs["/spec/containers/0"].newValue)
+
+	// The removed environment variable is reported at its old position
+	removed := diffs["/spec/containers/1/env/0"]
+	assert.Equal(t, opRemove, removed.op)
+	assert.Equal(t, "/spec/containers/name=app/env/name=A", removed.identity)
+	assert.Equal(t, map[string]interface{}{"name": "A", "value": "1"}, removed.oldValue)
+}
+
+func TestDiffObjectsReorderedListElements(t *testing.T) {
+	a := corev1.Container{Name: "a", Image: "a:1"}
+	b := corev1.Container{Name: "b", Image: "b:1"}
+	c := corev1.Container{Name: "c", Image: "c:1"}
+
+	// Moving a container to the front is a single move, not a change of every container
+	diffs := diffPaths(t, newPod(a, b, c), newPod(c, a, b))
+	assert.Equal(t, map[string]fieldDiff{
+		"/spec/containers/0": {op: opMove, path: "/spec/containers/0", from: "/spec/containers/2", identity: "/spec/containers/name=c"},
+	}, diffs)
+
+	// A moved container that also changed reports both
+	changed := *c.DeepCopy()
+	changed.Image = "c:2"
+	diffs = diffPaths(t, newPod(a, b, c), newPod(changed, a, b))
+	assert.Len(t, diffs, 2)
+	assert.Equal(t, opMove, diffs["/spec/containers/0"].op)
+	assert.Equal(t, fieldDiff{op: opReplace, path: "/spec/containers/0/image", identity: "/spec/containers/name=c/image", oldValue: "c:1", newValue: "c:2"},
+		diffs["/spec/containers/0/image"])
+}
+
+func TestDiffAndLogReorders(t *testing.T) {
+	a := corev1.Container{Name: "a", Image: "a:1", Env: []corev1.EnvVar{{Name: "A"}, {Name: "B"}}}
+	b := corev1.Container{Name: "b", Image: "b:1"}
+	reordered := *a.DeepCopy()
+	reordered.Env = []corev1.EnvVar{{Name: "B"}, {Name: "A"}}
+
+	// A reorder alone is not a change
+	changes, _ := diffAndLog(newPod(a, b), newPod(b, reordered), "default/web", nil, nil)
+	assert.Nil(t, changes)
+
+	// Along with a real change, the moves are reported too
+	changed := *b.DeepCopy()
+	changed.Image = "b:2"
+	changes, _ = diffAndLog(newPod(a, b), newPod(changed, a), "default/web", nil, nil)
+	var ops []string
+	for _, change := range toFieldChanges(changes) {
+		ops = append(ops, change.Op.String())
+	}
+	assert.ElementsMatch(t, []string{"OP_MOVE", "OP_REPLACE"}, ops)
+
+	// Reorders of the configured lists are reported on their own
+	original := reorderedLists
+	reorderedLists = newReorderedLists(" initContainers, env")
+	defer func() { reorderedLists = original }()
+	changes, _ = diffAndLog(newPod(a), newPod(reordered), "default/web", nil, nil)
+	assert.Len(t, changes, 1)
+	changes, _ = diffAndLog(newPod(a, b), newPod(b, a), "default/web", nil, nil)
+	assert.Nil(t, changes)
+}
+
+func TestDiffObjectsReplacedListElement(t *testing.T) {
+	a := corev1.Container{Name: "a", Image: "a:1"}
+	b := corev1.Container{Name: "b", Image: "b:1"}
+
+	// A container taking the place of a removed one is reported as added, and the removed one
+	// as removed at the same position
+	diffs, err := diffObjects(newPod(a), newPod(b))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []fieldDiff{
+		{op: opAdd, path: "/spec/containers/0", identity: "/spec/containers/name=b", newValue: toValue(t, b)},
+		{op: opRemove, path: "/spec/containers/0", identity: "/spec/containers/name=a", oldValue: toValue(t, a)},
+	}, diffs)
+}
+
+func TestDiffObjectsRemovedAndMovedListElements(t *testing.T) {
+	a := corev1.Container{Name: "a", Image: "a:1"}
+	b := corev1.Container{Name: "b", Image: "b:1"}
+	c := corev1.Container{Name: "c", Image: "c:1"}
+	changed := *c.DeepCopy()
+	changed.Image = "c:2"
+
+	// b is removed, c is changed and a and c swap places, which moves a to the old position of b
+	diffs, err := diffObjects(newPod(a, b, c), newPod(changed, a))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []fieldDiff{
+		{op: opMove, path: "/spec/containers/1", from: "/spec/containers/0", identity: "/spec/containers/name=a"},
+		{op: opReplace, path: "/spec/containers/0/image", identity: "/spec/containers/name=c/image", oldValue: "c:1", newValue: "c:2"},
+		{op: opRemove, path: "/spec/containers/1", identity: "/spec/containers/name=b", oldValue: toValue(t, b)},
+	}, diffs)
+
+	// In the changes of the event, the removal of b does not collide with a at the same position
+	changes, _ := diffAndLog(newPod(a, b, c), newPod(changed, a), "default/web", nil, nil)
+	assert.Len(t, changes, 3)
+	assert.Equal(t, "remove", changes["/spec/containers/name=b"].(map[string]interface{})["op"])
+	var paths []string
+	for _, fieldChange := range toFieldChanges(changes) {
+		paths = append(paths, fieldChange.Op.String()+" "+fieldChange.Path)
+	}
+	assert.Equal(t, []string{"OP_MOVE /spec/containers/1", "OP_REMOVE /spec/containers/1", "OP_REPLACE /spec/containers/0/image"}, paths)
+}
+
+// toValue returns a value as decoded from its JSON encoding.
+func toValue(t *testing.T, value interface{}) interface{} {
+	t.Helper()
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var decoded interface{}
+	_ = json.Unmarshal(data, &decoded)
+	return decoded
+}
+
+func TestDiffObjectsPorts(t *testing.T) {
+	http := corev1.ContainerPort{Name: "http", ContainerPort: 8080}
+	metrics := corev1.ContainerPort{Name: "metrics", ContainerPort: 9090}
+	renamed := corev1.ContainerPort{Name: "web", ContainerPort: 8080}
+
+	diffs := diffPaths(t,
+		newPod(corev1.Container{Name: "app", Ports: []corev1.ContainerPort{http, metrics}}),
+		newPod(corev1.Container{Name: "app", Ports: []corev1.ContainerPort{metrics, renamed}}))
+	// Swapping two ports moves one of them
+	assert.Len(t, diffs, 2)
+	assert.Equal(t, fieldDiff{op: opMove, path: "/spec/containers/0/ports/1", from: "/spec/containers/0/ports/0", identity: "/spec/containers/name=app/ports/containerPort=8080"},
+		diffs["/spec/containers/0/ports/1"])
+	assert.Equal(t, "web", diffs["/spec/containers/0/ports/1/name"].newValue)
+}
+
+func TestDiffObjectsUnkeyedLists(t *testing.T) {
+	// Arguments and containers without distinct names are compared by position
+	diffs := diffPaths(t,
+		newPod(corev1.Container{Name: "app", Args: []string{"--a", "--b"}}, corev1.Container{Name: "app"}),
+		newPod(corev1.Container{Name: "app", Args: []string{"--b"}}, corev1.Container{Name: "app"}))
+	assert.Equal(t, map[string]fieldDiff{
+		"/spec/containers/0/args/0": {op: opReplace, path: "/spec/containers/0/args/0", oldValue: "--a", newValue: "--b"},
+		"/spec/containers/0/args/1": {op: opRemove, path: "/spec/containers/0/args/1", oldValue: "--b"},
+	}, diffs)
+}
+
+func TestMovedElements(t *testing.T) {
+	// Old positions 2, 0, 1 in their new order: the element that came first moved
+	assert.Equal(t, map[int]bool{0: true}, movedElements([][2]int{{2, 0}, {0, 1}, {1, 2}}))
+	// Removing elements keeps the relative order of the others
+	assert.Empty(t, movedElements([][2]int{{1, 0}, {3, 1}}))
+	assert.Empty(t, movedElements(nil))
+}
+
+func TestToFieldChanges(t *testing.T) {
+	changes := map[string]interface{}{
+		"/spec/containers/0": fieldDiff{op: opMove, path: "/spec/containers/0", from: "/spec/containers/1", identity: "/spec/containers/name=b"}.entry(),
+		"/spec/replicas":     fieldDiff{op: opReplace, path: "/spec/replicas", oldValue: 1.0, newValue: 2.0}.entry(),
+		"/spec/paused":       fieldDiff{op: opAdd, path: "/spec/paused", newValue: true}.entry(),
+		"/spec/strategy":     fieldDiff{op: opRemove, path: "/spec/strategy", oldValue: map[string]interface{}{}}.entry(),
+	}
+	assert.Equal(t, []*eventpb.FieldChange{
+		{Path: "/spec/containers/0", Op: eventpb.FieldChange_OP_MOVE, From: "/spec/containers/1", Identity: "/spec/containers/name=b"},
+		{Path: "/spec/paused", Op: eventpb.FieldChange_OP_ADD, New: []byte("true")},
+		{Path: "/spec/replicas", Op: eventpb.FieldChange_OP_REPLACE, Old: []byte("1"), New: []byte("2")},
+		{Path: "/spec/strategy", Op: eventpb.FieldChange_OP_REMOVE, Old: []byte("{}")},
+	}, toFieldChanges(changes))
+}
+
+func TestJoinPointer(t *testing.T) {
+	assert.Equal(t, "/metadata/annotations/a~1b~0c", joinPointer([]string{"metadata", "annotations", "a/b~c"}))
+	assert.Equal(t, "", joinPointer(nil))
+}
@@ -0,0 +1,194 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Actions of an expression rule.
+const (
+	actionDrop = "drop"
+	actionKeep = "keep"
+)
+
+// celCostLimit bounds the work of a single evaluation, so that a costly expression cannot
+// stall the handler.
+const celCostLimit = 1000000
+
+// expressionSpec drops, keeps or tags the events on the objects in its scope with CEL
+// expressions. The expressions can use these variables:
+//
+//	object     the object, null for DELETED events
+//	oldObject  the previous state of the object, null for ADDED events
+//	changes    the changes of a MODIFIED event, a list of {path, op, old, new, from, identity}
+//	eventType  ADDED, MODIFIED or DELETED
+//	category   spec or status for MODIFIED events
+type expressionSpec struct {
+	scopeSpec
+	Match  string            `json:"match,omitempty"`  // A boolean expression, every event matches if empty
+	Action string            `json:"action,omitempty"` // drop, keep, or empty to only tag matching events
+	Tags   map[string]string `json:"tags,omitempty"`   // Expressions evaluating to strings, by tag name
+}
+
+// expressionRule is a compiled expressionSpec.
+type expressionRule struct {
+	scopeSpec
+	match  cel.Program // nil matches every event
+	action string
+	tags   map[string]cel.Program
+}
+
+// newCELEnv declares the variables available to expressions. Numbers of different types can
+// be compared, since changed values decoded from JSON are doubles.
+func newCELEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("object", cel.DynType),
+		cel.Variable("oldObject", cel.DynType),
+		cel.Variable("changes", cel.ListType(cel.DynType)),
+		cel.Variable("eventType", cel.StringType),
+		cel.Variable("category", cel.StringType),
+		cel.CrossTypeNumericComparisons(true),
+	)
+}
+
+// compileExpressionRule compiles the expressions of a rule and checks their result types.
+func compileExpressionRule(spec expressionSpec) (expressionRule, error) {
+	rule := expressionRule{scopeSpec: spec.scopeSpec, action: spec.Action}
+	if spec.Action != "" && spec.Action != actionDrop && spec.Action != actionKeep {
+		return rule, fmt.Errorf("unknown action %q", spec.Action)
+	}
+
+	env, err := newCELEnv()
+	if err != nil {
+		return rule, err
+	}
+	if spec.Match != "" {
+		if rule.match, err = compileExpression(env, spec.Match, cel.BoolType); err != nil {
+			return rule, fmt.Errorf("match: %w", err)
+		}
+	}
+	for name, expression := range spec.Tags {
+		program, err := compileExpression(env, expression, cel.StringType)
+		if err != nil {
+			return rule, fmt.Errorf("tag %s: %w", name, err)
+		}
+		if rule.tags == nil {
+			rule.tags = make(map[string]cel.Program)
+		}
+		rule.tags[name] = program
+	}
+	return rule, nil
+}
+
+// compileExpression compiles an expression that evaluates to the given type. Expressions on
+// the objects are checked at evaluation, since the fields of objects are not typed.
+func compileExpression(env *cel.Env, expression string, want *cel.Type) (cel.Program, error) {
+	ast, issues := env.Compile(expression)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if output := ast.OutputType(); !output.IsExactType(want) && !output.IsExactType(cel.DynType) {
+		return nil, fmt.Errorf("evaluates to %s instead of %s", output, want)
+	}
+	return env.Program(ast, cel.CostLimit(celCostLimit))
+}
+
+// evaluateExpressions runs the expression rules that apply to an event, in order, until one
+// that matches drops or keeps the event. Every matching rule adds its tags to the event. It
+// returns false if the event is dropped. An expression that fails, e.g. on a missing field,
+// does not match.
+func evaluateExpressions(eventMessage *eventpb.EventMessage, gvr schema.GroupVersionResource, oldObj, obj k8sruntime.Object, changes map[string]interface{}) bool {
+	rules := fieldRules.expressionsFor(gvr, eventMessage.Namespace)
+	if len(rules) == 0 {
+		return true
+	}
+
+	activation := map[string]interface{}{
+		"object":    objectContent(obj),
+		"oldObject": objectContent(oldObj),
+		"changes":   changeList(eventMessage.Changes, changes),
+		"eventType": eventMessage.EventType,
+		"category":  eventMessage.Category,
+	}
+	for _, rule := range rules {
+		if rule.match != nil {
+			result, _, err := rule.match.Eval(activation)
+			if err != nil {
+				debugLog("Error evaluating expression for %s/%s: %v", eventMessage.Namespace, eventMessage.Name, err)
+				continue
+			}
+			if matched, ok := result.Value().(bool); !ok || !matched {
+				continue
+			}
+		}
+
+		for name, program := range rule.tags {
+			result, _, err := program.Eval(activation)
+			if err != nil {
+				debugLog("Error evaluating tag %s for %s/%s: %v", name, eventMessage.Namespace, eventMessage.Name, err)
+				continue
+			}
+			value, ok := result.Value().(string)
+			if !ok {
+				debugLog("Tag %s for %s/%s is not a string", name, eventMessage.Namespace, eventMessage.Name)
+				continue
+			}
+			if eventMessage.Tags == nil {
+				eventMessage.Tags = make(map[string]string)
+			}
+			eventMessage.Tags[name] = value
+		}
+
+		switch rule.action {
+		case actionDrop:
+			return false
+		case actionKeep:
+			return true
+		}
+	}
+	return true
+}
+
+// objectContent returns the content of an object as seen by expressions, nil if there is none.
+func objectContent(obj k8sruntime.Object) interface{} {
+	if u, ok := obj.(k8sruntime.Unstructured); ok {
+		return u.UnstructuredContent()
+	}
+	return nil
+}
+
+// changeList returns the changes as seen by expressions, in the order of the field changes.
+func changeList(fieldChanges []*eventpb.FieldChange, changes map[string]interface{}) []interface{} {
+	list := make([]interface{}, 0, len(fieldChanges))
+	for _, fieldChange := range fieldChanges {
+		values, _ := changes[changeKey(fieldChange.Path, fieldChange.Identity)].(map[string]interface{})
+		list = append(list, map[string]interface{}{
+			"path":     fieldChange.Path,
+			"op":       strings.ToLower(strings.TrimPrefix(fieldChange.Op.String(), "OP_")),
+			"old":      values["old"],
+			"new":      values["new"],
+			"from":     fieldChange.From,
+			"identity": fieldChange.Identity,
+		})
+	}
+	return list
+}
@@ -0,0 +1,135 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// useRules replaces the rules file with one holding the given rules for the test.
+func useRules(t *testing.T, rules string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(file, []byte(rules), 0o600); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+	original := fieldRules
+	fieldRules = &ruleFile{path: file}
+	t.Cleanup(func() { fieldRules = original })
+}
+
+const testExpressions = `
+expressions:
+- resources: ["deployments"]
+  match: 'object.spec.replicas < 2 && oldObject.spec.replicas >= 2'
+  action: keep
+  tags:
+    severity: '"high"'
+    replicas: 'string(object.spec.replicas)'
+- resources: ["deployments"]
+  match: 'eventType == "MODIFIED"'
+  action: drop
+- resources: ["configmaps"]
+  match: '"control-plane.alpha.kubernetes.io/leader" in object.metadata.annotations'
+  action: drop
+- match: 'changes.exists(c, c.path == "/data/mode" && c.new == "debug")'
+  tags:
+    change: '"debug-enabled"'
+`
+
+func TestCompileExpressionRule(t *testing.T) {
+	_, err := parseRules([]byte(testExpressions))
+	assert.NoError(t, err)
+
+	for _, rules := range []string{
+		"expressions:\n- action: ignore\n",
+		"expressions:\n- match: '1 + 1'\n",
+		"expressions:\n- match: 'object.spec.'\n",
+		"expressions:\n- tags: {replicas: 'object.spec.replicas > 1'}\n",
+	} {
+		_, err := parseRules([]byte(rules))
+		assert.Error(t, err, rules)
+	}
+}
+
+func newDeployment(replicas int64) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("apps/v1")
+	obj.SetKind("Deployment")
+	obj.SetNamespace("default")
+	obj.SetName("web")
+	_ = unstructured.SetNestedField(obj.Object, replicas, "spec", "replicas")
+	return obj
+}
+
+func TestEvaluateExpressions(t *testing.T) {
+	useRules(t, testExpressions)
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	configMaps := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+	// Deployments scaled below 2 replicas are kept and tagged, other modifications are dropped
+	message := &eventpb.EventMessage{Namespace: "default", EventType: string(watch.Modified)}
+	assert.True(t, evaluateExpressions(message, deployments, newDeployment(3), newDeployment(1), nil))
+	assert.Equal(t, map[string]string{"severity": "high", "replicas": "1"}, message.Tags)
+
+	message = &eventpb.EventMessage{Namespace: "default", EventType: string(watch.Modified)}
+	assert.False(t, evaluateExpressions(message, deployments, newDeployment(3), newDeployment(2), nil))
+
+	// Expressions failing on the missing old object do not match
+	message = &eventpb.EventMessage{Namespace: "default", EventType: string(watch.Added)}
+	assert.True(t, evaluateExpressions(message, deployments, nil, newDeployment(1), nil))
+	assert.Nil(t, message.Tags)
+
+	leader := &unstructured.Unstructured{}
+	leader.SetAnnotations(map[string]string{"control-plane.alpha.kubernetes.io/leader": "{}"})
+	message = &eventpb.EventMessage{Namespace: "default", EventType: string(watch.Modified)}
+	assert.False(t, evaluateExpressions(message, configMaps, leader, leader, nil))
+
+	changes := map[string]interface{}{"/data/mode": map[string]interface{}{"op": "replace", "old": "info", "new": "debug"}}
+	message = &eventpb.EventMessage{Namespace: "default", EventType: string(watch.Modified), Changes: toFieldChanges(changes)}
+	assert.True(t, evaluateExpressions(message, configMaps, &unstructured.Unstructured{}, &unstructured.Unstructured{}, changes))
+	assert.Equal(t, map[string]string{"change": "debug-enabled"}, message.Tags)
+}
+
+func TestHandleEventExpressions(t *testing.T) {
+	useRules(t, testExpressions)
+	originalExternalSendEnabled := externalSendEnabled
+	externalSendEnabled = true
+	defer func() { externalSendEnabled = originalExternalSendEnabled }()
+
+	sink := &recordingSink{}
+	SetSink(sink)
+	defer SetSink(nil)
+
+	gvr := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	Seed(newDeployment(3), gvr)
+	HandleEvent(watch.Event{Type: watch.Modified, Object: newDeployment(2)}, gvr)
+	HandleEvent(watch.Event{Type: watch.Modified, Object: newDeployment(1)}, gvr)
+	HandleEvent(watch.Event{Type: watch.Deleted, Object: newDeployment(1)}, gvr)
+
+	if assert.Len(t, sink.messages, 2) {
+		assert.Equal(t, []string{"OP_REPLACE /spec/replicas 2 1"}, describeChanges(sink.messages[0].Changes))
+		assert.Equal(t, "high", sink.messages[0].Tags["severity"])
+		assert.Equal(t, string(watch.Deleted), sink.messages[1].EventType)
+	}
+}
@@ -15,20 +15,24 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"runtime"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/incidentassistant/k8s-agent/pkg/cache"
 	"github.com/incidentassistant/k8s-agent/pkg/client"
 	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
-	"github.com/tidwall/gjson"
-	"github.com/wI2L/jsondiff"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	k8sruntime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/watch"
@@ -36,153 +40,390 @@ import (
 
 // Read environment variables or set default values
 var (
-	apiKey              = os.Getenv("API_KEY")         // API key for authentication
 	destinationURL      = os.Getenv("DESTINATION_URL") // Central hub URL
-	debugEnabled        = os.Getenv("DEBUG_ENABLED") == "true"
 	externalSendEnabled = os.Getenv("EXTERNAL_SEND_ENABLED") != "false"
 )
 
+// debugEnabled and emissionPaused can be changed at runtime by the hub.
+var (
+	debugEnabled   atomic.Bool
+	emissionPaused atomic.Bool
+)
+
+func init() {
+	debugEnabled.Store(os.Getenv("DEBUG_ENABLED") == "true")
+}
+
 // debugLog prints log messages only if debug is enabled
 func debugLog(format string, v ...interface{}) {
-	if debugEnabled {
+	if debugEnabled.Load() {
 		log.Printf(format, v...)
 	}
 }
 
+// SetDebug turns debug logging on or off.
+func SetDebug(enabled bool) {
+	debugEnabled.Store(enabled)
+}
+
+// SetEmissionPaused pauses or resumes sending events. While paused, changes are still
+// tracked in the cache so that diffs stay correct once emission resumes.
+func SetEmissionPaused(paused bool) {
+	emissionPaused.Store(paused)
+}
+
+// NamespaceObjects returns the cached state of every watched object in the namespace.
+func NamespaceObjects(namespace string) []k8sruntime.Object {
+	var objects []k8sruntime.Object
+	for _, obj := range objCache.List(namespace + "/") {
+		// Keys of cluster-scoped objects start with their resource, which may share the prefix
+		if metaObj, err := meta.Accessor(obj); err == nil && metaObj.GetNamespace() == namespace {
+			objects = append(objects, obj)
+		}
+	}
+	return objects
+}
+
 var objCache = cache.NewObjectCache()
 
+// Forget evicts the cached objects of a resource that is no longer watched.
+func Forget(gvr schema.GroupVersionResource) {
+	resource := qualifiedResource(gvr)
+	evicted := objCache.DeleteFunc(func(key string, _ k8sruntime.Object) bool {
+		// Keys end with the qualified resource and the name, see objectKey
+		segments := strings.Split(key, "/")
+		return segments[len(segments)-2] == resource
+	})
+	debugLog("Evicted %d cached objects of %s", evicted, gvr)
+}
+
+// eventSink delivers event messages to the central hub. It is set once at startup by SetSink.
+var eventSink client.EventSink
+
+// SetSink sets the sink events are sent to. Without a sink, events are only logged.
+func SetSink(sink client.EventSink) {
+	eventSink = sink
+}
+
+// clusterID identifies the cluster in every event. It is set once at startup by SetClusterID.
+var clusterID string
+
+// SetClusterID sets the cluster ID attached to every event.
+func SetClusterID(id string) {
+	clusterID = id
+}
+
+// lastAppliedConfigAnnotation holds a full copy of the object written by kubectl apply.
+const lastAppliedConfigAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
 // HandleEvent handles the incoming Kubernetes event and performs the necessary actions based on the event type.
 func HandleEvent(event watch.Event, gvr schema.GroupVersionResource) {
-	obj, ok := event.Object.(k8sruntime.Unstructured) // Use aliased package
-	if !ok {
+	if _, ok := event.Object.(k8sruntime.Unstructured); !ok {
 		debugLog("Expected Unstructured, got %T for %s", event.Object, gvr.Resource)
 		return
 	}
 
-	metaObj, err := meta.Accessor(obj)
+	// Redact sensitive values before the object is cached, diffed, logged or sent. The
+	// redacted object is a copy, so it can be cached without copying it again.
+	obj, err := Redact(event.Object, gvr)
 	if err != nil {
-		debugLog("Error accessing object metadata: %v", err)
+		debugLog("Error redacting object: %v", err)
 		return
 	}
 
-	resourcePath := gvr.Resource
-	if namespace := metaObj.GetNamespace(); namespace != "" {
-		resourcePath = namespace + "/" + resourcePath
+	metaObj, err := meta.Accessor(obj)
+	if err != nil {
+		debugLog("Error accessing object metadata: %v", err)
+		return
 	}
 
-	key := resourcePath + "/" + metaObj.GetName()
+	key := objectKey(metaObj, gvr)
 
 	var eventData []byte
-	var changes map[string]interface{}
 
 	// Handle different event types
 	switch event.Type {
 	case watch.Added:
-		// Add the new object to the cache without logging or sending an event
-		objCache.Set(key, obj.DeepCopyObject())
+		// Objects from the initial list are seeded by the watcher, so an ADDED event for a key
+		// that is already cached is a replay rather than a new object and is not emitted
+		if _, exists := objCache.Get(key); exists {
+			objCache.Set(key, obj)
+			return
+		}
+		objCache.Set(key, obj)
+		logCreationEvent(obj, key)
+		eventData, err = json.Marshal(TrimObject(obj))
+		if err != nil {
+			debugLog("Error marshaling object: %v", err)
+			return
+		}
 	case watch.Modified:
 		oldObj, exists := objCache.Get(key)
-		if exists {
-			changes = diffAndLog(oldObj, obj, key)
-			if changes != nil {
-				eventData, err = json.Marshal(changes)
-				if err != nil {
-					debugLog("Error marshaling changes: %v", err)
-					return
-				}
-			}
-		} else {
+		objCache.Set(key, obj)
+		if !exists {
 			// If no old object is found, do not treat as a creation
 			// Skip logging and sending the event
 			return
 		}
-		objCache.Set(key, obj.DeepCopyObject())
+		// Spec and status changes are sent as separate events, so they can be handled separately
+		filter := fieldRules.forObject(gvr, metaObj.GetNamespace())
+		changes, statusChanges := diffAndLog(oldObj, obj, key, statusPaths(obj.GetObjectKind().GroupVersionKind().Kind), filter)
+		sendChanges(oldObj, obj, gvr, CategorySpec, changes)
+		sendChanges(oldObj, obj, gvr, CategoryStatus, statusChanges)
+		return
 	case watch.Deleted:
+		// Report the last state we knew of, falling back to the object carried by the event
+		lastObj := obj
+		if cachedObj, exists := objCache.Get(key); exists {
+			if cached, ok := cachedObj.(k8sruntime.Unstructured); ok {
+				lastObj = cached
+			}
+		}
 		objCache.Delete(key)
+		logDeletionEvent(lastObj, key)
+		eventData, err = json.Marshal(TrimObject(lastObj))
+		if err != nil {
+			debugLog("Error marshaling object: %v", err)
+			return
+		}
+		obj = lastObj
+	default:
+		return
 	}
 
-	// If changes were detected, create the event message without encryption
-	if changes != nil {
-		eventMessage := &eventpb.EventMessage{
-			Namespace:   metaObj.GetNamespace(),
-			ResourceKey: metaObj.GetName(),
-			EventType:   string(event.Type),
-			Data:        eventData,
-			ApiKey:      apiKey,
+	// Create the event message; the payload is encrypted by the sink if enabled
+	eventMessage, err := newEventMessage(event.Type, obj, gvr)
+	if err != nil {
+		debugLog("Error accessing object metadata: %v", err)
+		return
+	}
+	eventMessage.Data = eventData
+
+	oldObject, object := k8sruntime.Object(nil), k8sruntime.Object(obj)
+	if event.Type == watch.Deleted {
+		// Like in admission policies, expressions see a deleted object as the old object
+		oldObject, object = obj, nil
+	}
+	if !evaluateExpressions(eventMessage, gvr, oldObject, object, nil) {
+		return
+	}
+	send(eventMessage)
+}
+
+// sendChanges sends a MODIFIED event with the changes of a category, if there are any and
+// the expression rules do not drop it.
+func sendChanges(oldObj, obj k8sruntime.Object, gvr schema.GroupVersionResource, category string, changes map[string]interface{}) {
+	if changes == nil {
+		return
+	}
+
+	eventMessage, err := newEventMessage(watch.Modified, obj, gvr)
+	if err != nil {
+		debugLog("Error accessing object metadata: %v", err)
+		return
+	}
+	eventMessage.Changes = toFieldChanges(changes)
+	eventMessage.Category = category
+	if !evaluateExpressions(eventMessage, gvr, oldObj, obj, changes) {
+		return
+	}
+	send(eventMessage)
+}
+
+// send sends an event message to the central hub if enabled.
+func send(eventMessage *eventpb.EventMessage) {
+	if externalSendEnabled && eventSink != nil && !emissionPaused.Load() {
+		if err := eventSink.Send(context.Background(), eventMessage); err != nil {
+			debugLog("Error sending event: %v", err)
+			return
 		}
+		debugLog("Event sent to destination: %s", destinationURL)
+	}
+}
 
-		// Send the event message to the central hub if enabled
-		if externalSendEnabled {
-			grpcClient, err := client.NewEventServiceClient()
-			if err != nil {
-				debugLog("Error creating gRPC client: %v", err)
-				return
+// newEventMessage describes an event on obj, identified by its resource, kind and metadata.
+func newEventMessage(eventType watch.EventType, obj k8sruntime.Object, gvr schema.GroupVersionResource) (*eventpb.EventMessage, error) {
+	metaObj, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	eventMessage := &eventpb.EventMessage{
+		Namespace:       metaObj.GetNamespace(),
+		ResourceKey:     metaObj.GetName(),
+		EventType:       string(eventType),
+		ClusterId:       clusterID,
+		Group:           gvr.Group,
+		Version:         gvr.Version,
+		Kind:            obj.GetObjectKind().GroupVersionKind().Kind,
+		Resource:        gvr.Resource,
+		Name:            metaObj.GetName(),
+		Uid:             string(metaObj.GetUID()),
+		ResourceVersion: metaObj.GetResourceVersion(),
+		Generation:      metaObj.GetGeneration(),
+		ObservedAt:      timestamppb.Now(),
+		Labels:          metaObj.GetLabels(),
+	}
+	for _, owner := range metaObj.GetOwnerReferences() {
+		eventMessage.OwnerReferences = append(eventMessage.OwnerReferences, &eventpb.OwnerReference{
+			ApiVersion: owner.APIVersion,
+			Kind:       owner.Kind,
+			Name:       owner.Name,
+			Uid:        string(owner.UID),
+			Controller: owner.Controller != nil && *owner.Controller,
+		})
+	}
+	return eventMessage, nil
+}
+
+// fieldChangeOps maps the operations of the changes map to those of field changes.
+var fieldChangeOps = map[string]eventpb.FieldChange_Op{
+	opAdd:     eventpb.FieldChange_OP_ADD,
+	opRemove:  eventpb.FieldChange_OP_REMOVE,
+	opReplace: eventpb.FieldChange_OP_REPLACE,
+	opMove:    eventpb.FieldChange_OP_MOVE,
+}
+
+// toFieldChanges converts the changes found by diffAndLog into typed field changes, sorted by
+// path or, within keyed lists, by identity.
+func toFieldChanges(changes map[string]interface{}) []*eventpb.FieldChange {
+	keys := make([]string, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fieldChanges := make([]*eventpb.FieldChange, 0, len(keys))
+	for _, key := range keys {
+		values, ok := changes[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		op, _ := values["op"].(string)
+		path, ok := values["path"].(string)
+		if !ok {
+			path = key
+		}
+		fieldChange := &eventpb.FieldChange{Path: path, Op: fieldChangeOps[op]}
+		fieldChange.From, _ = values["from"].(string)
+		fieldChange.Identity, _ = values["identity"].(string)
+		// Moved fields keep their value, which is not repeated
+		var err error
+		if op == opReplace || op == opRemove {
+			if fieldChange.Old, err = json.Marshal(values["old"]); err != nil {
+				debugLog("Error marshaling old value of %s: %v", path, err)
+				continue
 			}
-			response, err := client.SendEvent(grpcClient, eventMessage)
-			if err != nil {
-				debugLog("Error sending event: %v", err)
-				return
+		}
+		if op == opReplace || op == opAdd {
+			if fieldChange.New, err = json.Marshal(values["new"]); err != nil {
+				debugLog("Error marshaling new value of %s: %v", path, err)
+				continue
 			}
-			debugLog("Event sent to destination: %s, Acknowledged: %v", destinationURL, response.Acknowledged)
 		}
+		fieldChanges = append(fieldChanges, fieldChange)
 	}
+	return fieldChanges
 }
 
-// diffAndLog compares two Kubernetes runtime objects, logs the differences, and returns the changes.
-// It takes the oldObj and newObj as k8sruntime.Object, and the key as a string.
-// If there is an error during marshaling, comparing, or marshaling changes, it logs the error and returns nil.
-// If there are no relevant changes, it logs the creation event and returns nil.
-// Otherwise, it creates a map to hold the changes with old and new values, logs the changes, and returns the map.
-func diffAndLog(oldObj, newObj k8sruntime.Object, key string) map[string]interface{} {
-	oldObjJSON, err := json.Marshal(oldObj)
+// Seed stores the object in the cache without emitting anything, so that the first
+// modification observed after the initial list is diffed against a known state.
+func Seed(obj k8sruntime.Object, gvr schema.GroupVersionResource) {
+	redacted, err := Redact(obj, gvr)
 	if err != nil {
-		debugLog("Error marshaling old object: %v", err)
-		return nil
+		debugLog("Error redacting object: %v", err)
+		return
 	}
 
-	newObjJSON, err := json.Marshal(newObj)
+	metaObj, err := meta.Accessor(redacted)
 	if err != nil {
-		debugLog("Error marshaling new object: %v", err)
-		return nil
+		debugLog("Error accessing object metadata: %v", err)
+		return
+	}
+
+	objCache.Set(objectKey(metaObj, gvr), redacted)
+}
+
+// objectKey builds the cache key for an object: [namespace/]resource[.group]/name. The group
+// keeps apart resources of the same name, e.g. the services of Knative and of the core group.
+func objectKey(metaObj metav1.Object, gvr schema.GroupVersionResource) string {
+	resourcePath := qualifiedResource(gvr)
+	if namespace := metaObj.GetNamespace(); namespace != "" {
+		resourcePath = namespace + "/" + resourcePath
+	}
+
+	return resourcePath + "/" + metaObj.GetName()
+}
+
+// qualifiedResource returns the resource with its group, or the resource alone for the core group.
+func qualifiedResource(gvr schema.GroupVersionResource) string {
+	if gvr.Group == "" {
+		return gvr.Resource
 	}
+	return gvr.Resource + "." + gvr.Group
+}
 
-	patch, err := jsondiff.Compare(oldObj, newObj)
+// diffAndLog compares two Kubernetes runtime objects, logs the differences, and returns the changes.
+// It takes the oldObj and newObj as k8sruntime.Object, the key as a string, the status fields
+// to report for the object's kind, and the field rules that apply to the object.
+// If there is an error during marshaling or comparing, it logs the error and returns nil.
+// Otherwise, it returns maps holding the spec changes and the status changes by path, each nil
+// if there are no relevant changes.
+func diffAndLog(oldObj, newObj k8sruntime.Object, key string, statusPaths []pathPattern, filter fieldFilter) (changes, statusChanges map[string]interface{}) {
+	diffs, err := diffObjects(oldObj, newObj)
 	if err != nil {
 		debugLog("Error comparing objects: %v", err)
-		return nil
+		return nil, nil
 	}
 
-	filteredPatch := filterPatch(patch)
+	// Create maps to hold the changes with their operation and old and new values
+	changes = toChanges(filterPatch(diffs), filter)
+	statusChanges = toChanges(filterStatusPatch(diffs, statusPaths), filter)
 
-	// If there are no relevant changes, log creation instead
-	if len(filteredPatch) == 0 {
-		logCreationEvent(newObj, key)
+	logChanges(key, CategorySpec, changes)
+	logChanges(key, CategoryStatus, statusChanges)
+	return changes, statusChanges
+}
+
+// toChanges returns the changes map of the diffs the field rules keep, nil if there are none
+// or if they only reorder list elements.
+func toChanges(diffs []fieldDiff, filter fieldFilter) map[string]interface{} {
+	var kept []fieldDiff
+	for _, diff := range diffs {
+		if filter.keeps(splitPointer(diff.path)) {
+			kept = append(kept, diff)
+		}
+	}
+	if onlyReorders(kept) {
 		return nil
 	}
 
-	// Create a map to hold the changes with old and new values
-	changes := make(map[string]interface{})
-
-	for _, op := range filteredPatch {
-		if op.Type == "replace" || (op.Type == "add" && op.OldValue != nil) {
-			gjsonPath := strings.ReplaceAll(strings.TrimPrefix(op.Path, "/"), "/", ".")
-			oldValue := gjson.GetBytes(oldObjJSON, gjsonPath)
-			newValue := gjson.GetBytes(newObjJSON, gjsonPath)
-			// Only log and send changes if the old value is not null
-			if oldValue.Type != gjson.Null {
-				changes[op.Path] = map[string]interface{}{
-					"old": oldValue.Value(),
-					"new": newValue.Value(),
-				}
-			}
-		}
+	var changes map[string]interface{}
+	for _, diff := range kept {
+		changes = addChange(changes, diff)
+	}
+	return changes
+}
+
+// addChange adds a change to the changes map, creating the map if needed.
+func addChange(changes map[string]interface{}, diff fieldDiff) map[string]interface{} {
+	if changes == nil {
+		changes = make(map[string]interface{})
+	}
+	changes[diff.key()] = diff.entry()
+	return changes
+}
+
+// logChanges logs the changes of a category along with the memory usage, if there are any.
+func logChanges(key, category string, changes map[string]interface{}) {
+	if changes == nil || !debugEnabled.Load() {
+		return
 	}
 
-	// Log the changes
 	changesBytes, err := json.MarshalIndent(changes, "", "    ")
 	if err != nil {
 		debugLog("Error marshaling changes: %v", err)
-		return nil
+		return
 	}
 
 	// Get memory usage
@@ -191,33 +432,81 @@ func diffAndLog(oldObj, newObj k8sruntime.Object, key string) map[string]interfa
 	memUsage := fmt.Sprintf("Alloc: %v MiB, TotalAlloc: %v MiB, Sys: %v MiB, NumGC: %v",
 		memStats.Alloc/1024/1024, memStats.TotalAlloc/1024/1024, memStats.Sys/1024/1024, memStats.NumGC)
 
-	debugLog("Time: %s, Resource Path: %s, Changes: %s, Memory: %s\n", time.Now().Format(time.RFC3339), key, string(changesBytes), memUsage)
-
-	return changes
+	debugLog("Time: %s, Resource Path: %s, Category: %s, Changes: %s, Memory: %s\n", time.Now().Format(time.RFC3339), key, category, string(changesBytes), memUsage)
 }
 
 // logCreationEvent logs the creation event with the entire object.
 // It takes in the object to be logged and the key representing the resource path.
 // It marshals the object into JSON format and logs the creation event along with the current time, resource path, and object.
 func logCreationEvent(obj k8sruntime.Object, key string) {
-	// Log the creation event with the entire object
+	logObjectEvent(obj, key, "create")
+}
+
+// logDeletionEvent logs the deletion event with the last known state of the object.
+func logDeletionEvent(obj k8sruntime.Object, key string) {
+	logObjectEvent(obj, key, "delete")
+}
+
+// logObjectEvent logs an operation on a whole object along with the current time and resource path.
+func logObjectEvent(obj k8sruntime.Object, key, operation string) {
 	objJSON, err := json.Marshal(obj)
 	if err != nil {
 		debugLog("Error marshaling object: %v", err)
 		return
 	}
 
-	debugLog("Time: %s, Resource Path: %s, Object: %s\n", time.Now().Format(time.RFC3339), key, string(objJSON))
+	debugLog("Time: %s, Resource Path: %s, Operation: %s, Object: %s\n", time.Now().Format(time.RFC3339), key, operation, string(objJSON))
+}
+
+// TrimObject returns a copy of the object's content without the bookkeeping fields that
+// bloat snapshots but carry no meaning for incident responders.
+func TrimObject(obj k8sruntime.Unstructured) map[string]interface{} {
+	content := k8sruntime.DeepCopyJSON(obj.UnstructuredContent())
+	unstructured.RemoveNestedField(content, "metadata", "managedFields")
+	unstructured.RemoveNestedField(content, "metadata", "annotations", lastAppliedConfigAnnotation)
+	return content
+}
+
+// trackedMetadataFields are the metadata fields whose changes are meaningful: labels select
+// pods for services, annotations configure controllers and trigger rollouts, owner references
+// tie objects together, and finalizers and the deletion timestamp show a pending deletion.
+// Bookkeeping such as resourceVersion, managedFields, generation or uid is left out.
+var trackedMetadataFields = map[string]bool{
+	"labels":            true,
+	"annotations":       true,
+	"ownerReferences":   true,
+	"finalizers":        true,
+	"deletionTimestamp": true,
 }
 
-// filterPatch filters the given jsondiff.Patch by removing operations that have paths starting with "/metadata" or "/status".
-// It returns the filtered jsondiff.Patch.
-func filterPatch(patch jsondiff.Patch) jsondiff.Patch {
-	var filteredPatch jsondiff.Patch
+// filterPatch filters the given changes by removing those of the status and of metadata
+// bookkeeping fields.
+// It returns the filtered changes.
+func filterPatch(patch []fieldDiff) []fieldDiff {
+	var filteredPatch []fieldDiff
 	for _, op := range patch {
-		if !strings.HasPrefix(op.Path, "/metadata") && !strings.HasPrefix(op.Path, "/status") {
+		if trackedPath(splitPointer(op.path)) {
 			filteredPatch = append(filteredPatch, op)
 		}
 	}
 	return filteredPatch
 }
+
+// trackedPath reports whether changes of the field at the given pointer segments are reported
+// as spec changes.
+func trackedPath(segments []string) bool {
+	if len(segments) == 0 {
+		return false
+	}
+	switch segments[0] {
+	case "status":
+		return false
+	case "metadata":
+		if len(segments) < 2 || !trackedMetadataFields[segments[1]] {
+			return false
+		}
+		// The last applied configuration duplicates the whole object
+		return !(segments[1] == "annotations" && len(segments) > 2 && segments[2] == lastAppliedConfigAnnotation)
+	}
+	return true
+}
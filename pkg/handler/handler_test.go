@@ -20,13 +20,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 	"testing"
 
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
 	"github.com/stretchr/testify/assert"
-	jsondiff "github.com/wI2L/jsondiff"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	k8sruntime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -34,14 +36,11 @@ import (
 	"k8s.io/client-go/kubernetes/fake"
 )
 
-// Import the eventpb package if it's external
-// import eventpb "github.com/incidentassistant/k8s-agent/proto/event"
-
 func TestLogCreationEvent(t *testing.T) {
 	// Set debugEnabled to true to ensure logs are printed
-	originalDebugEnabled := debugEnabled
-	debugEnabled = true
-	defer func() { debugEnabled = originalDebugEnabled }()
+	originalDebugEnabled := debugEnabled.Load()
+	debugEnabled.Store(true)
+	defer func() { debugEnabled.Store(originalDebugEnabled) }()
 
 	// Create a mock object
 	mockObj := &corev1.Pod{
@@ -82,18 +81,29 @@ func TestLogCreationEvent(t *testing.T) {
 
 func TestFilterPatch(t *testing.T) {
 	// Define the input patch
-	patch := jsondiff.Patch{
-		jsondiff.Operation{Type: "add", Path: "/metadata/name", Value: "test-pod"},
-		jsondiff.Operation{Type: "add", Path: "/metadata/labels/test-label", Value: "test-value"},
-		jsondiff.Operation{Type: "add", Path: "/status/phase", Value: "Running"},
-		jsondiff.Operation{Type: "remove", Path: "/spec/containers/0"},
+	patch := []fieldDiff{
+		{op: "add", path: "/metadata/name", newValue: "test-pod"},
+		{op: "add", path: "/metadata/labels/test-label", newValue: "test-value"},
+		{op: "replace", path: "/metadata/resourceVersion", newValue: "2"},
+		{op: "add", path: "/metadata/managedFields/1", newValue: map[string]interface{}{}},
+		{op: "add", path: "/metadata/annotations/kubectl.kubernetes.io~1restartedAt", newValue: "now"},
+		{op: "replace", path: "/metadata/annotations/kubectl.kubernetes.io~1last-applied-configuration", newValue: "{}"},
+		{op: "add", path: "/metadata/finalizers", newValue: []interface{}{"example.com/cleanup"}},
+		{op: "add", path: "/metadata/deletionTimestamp", newValue: "2024-01-01T00:00:00Z"},
+		{op: "add", path: "/status/phase", newValue: "Running"},
+		{op: "remove", path: "/spec/containers/0"},
 	}
 
 	// Define the expected filtered patch
-	// Since the filterPatch function removes operations with paths starting with "/metadata" or "/status",
-	// the expected filtered patch should only contain operations that do not start with these paths.
-	expectedFilteredPatch := jsondiff.Patch{
-		jsondiff.Operation{Type: "remove", Path: "/spec/containers/0"},
+	// The filterPatch function removes operations on the status and on metadata bookkeeping
+	// fields, but keeps labels, annotations other than the last applied configuration,
+	// finalizers and the deletion timestamp.
+	expectedFilteredPatch := []fieldDiff{
+		{op: "add", path: "/metadata/labels/test-label", newValue: "test-value"},
+		{op: "add", path: "/metadata/annotations/kubectl.kubernetes.io~1restartedAt", newValue: "now"},
+		{op: "add", path: "/metadata/finalizers", newValue: []interface{}{"example.com/cleanup"}},
+		{op: "add", path: "/metadata/deletionTimestamp", newValue: "2024-01-01T00:00:00Z"},
+		{op: "remove", path: "/spec/containers/0"},
 	}
 
 	// Call the filterPatch function
@@ -136,10 +146,11 @@ func TestDiffAndLog(t *testing.T) {
 	// Modify newObj to simulate a change
 	newPod := newObj.(*corev1.Pod)
 	newPod.Labels["test-label"] = "new-value"
+	newPod.ResourceVersion = "2"
 	newPod.Spec.Containers[0].Image = "new-image" // Simulate a change in the container image
 
 	// Call the diffAndLog function
-	changes := diffAndLog(oldObj, newObj, "default/test-pod")
+	changes, _ := diffAndLog(oldObj, newObj, "default/test-pod", nil, nil)
 
 	// Assert that the changes map is not nil
 	assert.NotNil(t, changes, "Expected changes to be detected, but got nil")
@@ -147,18 +158,43 @@ func TestDiffAndLog(t *testing.T) {
 	// Assert that the changes map is not empty
 	assert.NotEmpty(t, changes, "Expected changes to be detected, but map is empty")
 
-	// Assert that the changes map contains the specific change we made to the container image
+	// Assert that the changes map contains the changes we made to the container image and the
+	// label, but not the bookkeeping change of the resource version
 	expectedChanges := map[string]interface{}{
-		"/spec/containers/0/image": map[string]interface{}{
-			"old": "test-image",
-			"new": "new-image",
+		"/spec/containers/name=test-container/image": map[string]interface{}{
+			"op":       "replace",
+			"old":      "test-image",
+			"new":      "new-image",
+			"identity": "/spec/containers/name=test-container/image",
+			"path":     "/spec/containers/0/image",
+		},
+		"/metadata/labels/test-label": map[string]interface{}{
+			"op":  "replace",
+			"old": "test-value",
+			"new": "new-value",
 		},
 	}
 	assert.Equal(t, expectedChanges, changes, "Changes detected do not match expected changes")
+}
+
+func TestDiffAndLogEscapedKeys(t *testing.T) {
+	restartedAt := "kubectl.kubernetes.io/restartedAt"
+	oldObj := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        "test-pod",
+		Annotations: map[string]string{restartedAt: "2024-01-01T00:00:00Z"},
+	}}
+	newObj := oldObj.DeepCopy()
+	newObj.Annotations[restartedAt] = "2024-01-02T00:00:00Z"
 
-	// The label change should not be present in the changes map because it's under the /metadata path
-	_, labelChangeDetected := changes["/metadata/labels/test-label"]
-	assert.False(t, labelChangeDetected, "Label change should not be detected due to filterPatch function")
+	// Dots and slashes in keys must not be taken for path separators
+	changes, _ := diffAndLog(oldObj, newObj, "default/test-pod", nil, nil)
+	assert.Equal(t, map[string]interface{}{
+		"/metadata/annotations/kubectl.kubernetes.io~1restartedAt": map[string]interface{}{
+			"op":  "replace",
+			"old": "2024-01-01T00:00:00Z",
+			"new": "2024-01-02T00:00:00Z",
+		},
+	}, changes)
 }
 
 func TestHandleEvent(t *testing.T) {
@@ -192,3 +228,258 @@ func TestHandleEvent(t *testing.T) {
 	// Since we cannot directly observe the side effects of HandleEvent (like sending a message to a gRPC service),
 	// we would need to use mocking or a similar technique to test those side effects.
 }
+
+func TestHandleEventCreateAndDelete(t *testing.T) {
+	originalDebugEnabled, originalExternalSendEnabled := debugEnabled.Load(), externalSendEnabled
+	debugEnabled.Store(true)
+	externalSendEnabled = false
+	defer func() {
+		debugEnabled.Store(originalDebugEnabled)
+		externalSendEnabled = originalExternalSendEnabled
+	}()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetNamespace("default")
+	obj.SetName("created-config")
+
+	HandleEvent(watch.Event{Type: watch.Added, Object: obj}, gvr)
+	assert.Equal(t, 1, strings.Count(buf.String(), "Operation: create"), "Expected the creation to be logged once")
+
+	// A replayed ADDED event for a cached object is not a new creation
+	HandleEvent(watch.Event{Type: watch.Added, Object: obj}, gvr)
+	assert.Equal(t, 1, strings.Count(buf.String(), "Operation: create"), "Replayed ADDED event should not be logged as a creation")
+
+	HandleEvent(watch.Event{Type: watch.Deleted, Object: obj}, gvr)
+	assert.Contains(t, buf.String(), "Operation: delete")
+
+	_, exists := objCache.Get("default/configmaps/created-config")
+	assert.False(t, exists, "Deleted object should be removed from the cache")
+}
+
+func TestTrimObject(t *testing.T) {
+	obj := &unstructured.Unstructured{}
+	obj.SetName("test-config")
+	obj.SetAnnotations(map[string]string{
+		lastAppliedConfigAnnotation: "{}",
+		"team":                      "payments",
+	})
+	obj.SetManagedFields([]metav1.ManagedFieldsEntry{{Manager: "kubectl"}})
+
+	trimmed := TrimObject(obj)
+
+	_, found, _ := unstructured.NestedFieldNoCopy(trimmed, "metadata", "managedFields")
+	assert.False(t, found, "managedFields should be trimmed")
+	annotations, _, _ := unstructured.NestedStringMap(trimmed, "metadata", "annotations")
+	assert.Equal(t, map[string]string{"team": "payments"}, annotations)
+
+	// The original object must be left untouched
+	assert.Len(t, obj.GetManagedFields(), 1)
+}
+
+// recordingSink records every event message sent to it.
+type recordingSink struct {
+	messages []*eventpb.EventMessage
+}
+
+func (s *recordingSink) Send(ctx context.Context, eventMessage *eventpb.EventMessage) error {
+	s.messages = append(s.messages, eventMessage)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+func TestHandleEventSendsToSink(t *testing.T) {
+	originalExternalSendEnabled := externalSendEnabled
+	externalSendEnabled = true
+	defer func() { externalSendEnabled = originalExternalSendEnabled }()
+
+	sink := &recordingSink{}
+	SetSink(sink)
+	defer SetSink(nil)
+	SetClusterID("cluster-1")
+	defer SetClusterID("")
+
+	gvr := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("apps/v1")
+	obj.SetKind("Deployment")
+	obj.SetNamespace("default")
+	obj.SetName("web")
+	obj.SetUID("uid-1")
+	obj.SetResourceVersion("41")
+	obj.SetLabels(map[string]string{"app": "web"})
+	controller := true
+	obj.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "example.com/v1", Kind: "App", Name: "web", UID: "uid-0", Controller: &controller}})
+	_ = unstructured.SetNestedField(obj.Object, int64(3), "spec", "replicas")
+	Seed(obj, gvr)
+
+	updated := obj.DeepCopy()
+	updated.SetResourceVersion("42")
+	updated.SetGeneration(2)
+	_ = unstructured.SetNestedField(updated.Object, int64(1), "spec", "replicas")
+	HandleEvent(watch.Event{Type: watch.Modified, Object: updated}, gvr)
+
+	if assert.Len(t, sink.messages, 1) {
+		message := sink.messages[0]
+		assert.Equal(t, "default", message.Namespace)
+		assert.Equal(t, "web", message.ResourceKey)
+		assert.Equal(t, string(watch.Modified), message.EventType)
+		assert.Empty(t, message.Data, "Expected the changes to be sent only once")
+		assert.Equal(t, []string{"OP_REPLACE /spec/replicas 3 1"}, describeChanges(message.Changes))
+
+		assert.Equal(t, "cluster-1", message.ClusterId)
+		assert.Equal(t, []string{"apps", "v1", "Deployment", "deployments", "web"},
+			[]string{message.Group, message.Version, message.Kind, message.Resource, message.Name})
+		assert.Equal(t, "uid-1", message.Uid)
+		assert.Equal(t, "42", message.ResourceVersion)
+		assert.Equal(t, int64(2), message.Generation)
+		assert.NotNil(t, message.ObservedAt)
+		assert.Equal(t, map[string]string{"app": "web"}, message.Labels)
+		if assert.Len(t, message.OwnerReferences, 1) {
+			assert.Equal(t, "App", message.OwnerReferences[0].Kind)
+			assert.True(t, message.OwnerReferences[0].Controller)
+		}
+		if assert.Len(t, message.Changes, 1) {
+			change := message.Changes[0]
+			assert.Equal(t, "/spec/replicas", change.Path)
+			assert.Equal(t, eventpb.FieldChange_OP_REPLACE, change.Op)
+			assert.JSONEq(t, "3", string(change.Old))
+			assert.JSONEq(t, "1", string(change.New))
+		}
+	}
+}
+
+func TestHandleEventPaused(t *testing.T) {
+	originalExternalSendEnabled := externalSendEnabled
+	externalSendEnabled = true
+	defer func() { externalSendEnabled = originalExternalSendEnabled }()
+
+	sink := &recordingSink{}
+	SetSink(sink)
+	defer SetSink(nil)
+
+	SetEmissionPaused(true)
+	defer SetEmissionPaused(false)
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetNamespace("paused")
+	obj.SetName("settings")
+	_ = unstructured.SetNestedField(obj.Object, "a", "data", "key")
+	Seed(obj, gvr)
+
+	updated := obj.DeepCopy()
+	_ = unstructured.SetNestedField(updated.Object, "b", "data", "key")
+	HandleEvent(watch.Event{Type: watch.Modified, Object: updated}, gvr)
+	assert.Empty(t, sink.messages)
+
+	// The change was still tracked, so resuming does not replay it
+	SetEmissionPaused(false)
+	HandleEvent(watch.Event{Type: watch.Modified, Object: updated.DeepCopy()}, gvr)
+	assert.Empty(t, sink.messages)
+}
+
+func TestHandleEventSameNameInOtherGroup(t *testing.T) {
+	originalExternalSendEnabled := externalSendEnabled
+	externalSendEnabled = true
+	defer func() { externalSendEnabled = originalExternalSendEnabled }()
+
+	sink := &recordingSink{}
+	SetSink(sink)
+	defer SetSink(nil)
+
+	// Knative creates a core service with the name of its own service
+	coreGVR := schema.GroupVersionResource{Version: "v1", Resource: "services"}
+	knativeGVR := schema.GroupVersionResource{Group: "serving.knative.dev", Version: "v1", Resource: "services"}
+	core := &unstructured.Unstructured{}
+	core.SetAPIVersion("v1")
+	core.SetKind("Service")
+	core.SetNamespace("groups")
+	core.SetName("hello")
+	_ = unstructured.SetNestedField(core.Object, "ClusterIP", "spec", "type")
+	knative := &unstructured.Unstructured{}
+	knative.SetAPIVersion("serving.knative.dev/v1")
+	knative.SetKind("Service")
+	knative.SetNamespace("groups")
+	knative.SetName("hello")
+	_ = unstructured.SetNestedField(knative.Object, "hello:1", "spec", "template", "spec", "containers", "image")
+	Seed(core, coreGVR)
+	Seed(knative, knativeGVR)
+	assert.Len(t, NamespaceObjects("groups"), 2)
+
+	updated := knative.DeepCopy()
+	_ = unstructured.SetNestedField(updated.Object, "hello:2", "spec", "template", "spec", "containers", "image")
+	HandleEvent(watch.Event{Type: watch.Modified, Object: updated}, knativeGVR)
+
+	// The update is diffed against the Knative service only
+	if assert.Len(t, sink.messages, 1) {
+		assert.Equal(t, "serving.knative.dev", sink.messages[0].Group)
+		assert.Equal(t, []string{`OP_REPLACE /spec/template/spec/containers/image "hello:1" "hello:2"`}, describeChanges(sink.messages[0].Changes))
+	}
+}
+
+func TestNamespaceObjects(t *testing.T) {
+	configMap := &unstructured.Unstructured{}
+	configMap.SetAPIVersion("v1")
+	configMap.SetKind("ConfigMap")
+	configMap.SetNamespace("snapshot")
+	configMap.SetName("settings")
+	Seed(configMap, schema.GroupVersionResource{Version: "v1", Resource: "configmaps"})
+
+	// A cluster-scoped resource whose name matches the namespace must not be included
+	node := &unstructured.Unstructured{}
+	node.SetAPIVersion("v1")
+	node.SetKind("Snapshot")
+	node.SetName("node-1")
+	Seed(node, schema.GroupVersionResource{Version: "v1", Resource: "snapshot"})
+
+	objects := NamespaceObjects("snapshot")
+	if assert.Len(t, objects, 1) {
+		assert.Equal(t, "settings", objects[0].(*unstructured.Unstructured).GetName())
+	}
+}
+
+func TestForget(t *testing.T) {
+	configMap := &unstructured.Unstructured{}
+	configMap.SetAPIVersion("v1")
+	configMap.SetKind("ConfigMap")
+	configMap.SetNamespace("forget")
+	configMap.SetName("settings")
+	Seed(configMap, schema.GroupVersionResource{Version: "v1", Resource: "configmaps"})
+
+	// A resource of another group with the same name is kept
+	other := &unstructured.Unstructured{}
+	other.SetAPIVersion("example.com/v1")
+	other.SetKind("ConfigMap")
+	other.SetNamespace("forget")
+	other.SetName("settings")
+	Seed(other, schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "configmaps"})
+
+	Forget(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"})
+	objects := NamespaceObjects("forget")
+	if assert.Len(t, objects, 1) {
+		assert.Equal(t, "example.com/v1", objects[0].(*unstructured.Unstructured).GetAPIVersion())
+	}
+	Forget(schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "configmaps"})
+	assert.Empty(t, NamespaceObjects("forget"))
+}
+
+// describeChanges returns every field change as its operation, path, old and new value.
+func describeChanges(changes []*eventpb.FieldChange) []string {
+	var described []string
+	for _, change := range changes {
+		described = append(described, fmt.Sprintf("%s %s %s %s", change.Op, change.Path, change.Old, change.New))
+	}
+	return described
+}
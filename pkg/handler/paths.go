@@ -0,0 +1,113 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"log"
+	"path"
+	"strings"
+)
+
+// pathPattern matches JSON pointers segment by segment. Each segment may contain
+// path.Match wildcards, e.g. "/spec/template/spec/containers/*/image" matches the
+// image of every container of a pod template.
+type pathPattern []string
+
+// parsePathPattern parses a pattern written as a JSON pointer, returning false if it is malformed.
+func parsePathPattern(spec string) (pathPattern, bool) {
+	if !strings.HasPrefix(spec, "/") {
+		return nil, false
+	}
+	p := pathPattern(splitPointer(spec))
+	for _, segment := range p {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, false
+		}
+	}
+	return p, true
+}
+
+// parsePathPatterns parses a comma-separated list of patterns, skipping malformed entries.
+func parsePathPatterns(specs string) []pathPattern {
+	var patterns []pathPattern
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		p, ok := parsePathPattern(spec)
+		if !ok {
+			log.Printf("Ignoring invalid path pattern %q", spec)
+			continue
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+// matchSegment reports whether a pattern segment matches a pointer segment.
+func matchSegment(pattern, segment string) bool {
+	ok, _ := path.Match(pattern, segment)
+	return ok
+}
+
+// splitPointer splits a JSON pointer into its unescaped segments.
+func splitPointer(pointer string) []string {
+	if pointer == "" {
+		return nil
+	}
+	segments := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(strings.ReplaceAll(segment, "~1", "/"), "~0", "~")
+	}
+	return segments
+}
+
+// overlaps reports whether the pattern matches the pointer, one of its parents or one of
+// its children, i.e. whether the pointer is, contains or is contained by a matching field.
+func (p pathPattern) overlaps(segments []string) bool {
+	n := len(p)
+	if len(segments) < n {
+		n = len(segments)
+	}
+	for i := 0; i < n; i++ {
+		if !matchSegment(p[i], segments[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// covers reports whether the pattern matches the pointer or one of its parents, i.e. whether
+// the pointer is or is contained by a matching field.
+func (p pathPattern) covers(segments []string) bool {
+	return len(segments) >= len(p) && p.overlaps(segments)
+}
+
+// joinPointer joins unescaped segments into a JSON pointer.
+func joinPointer(segments []string) string {
+	var b strings.Builder
+	for _, segment := range segments {
+		b.WriteByte('/')
+		b.WriteString(strings.ReplaceAll(strings.ReplaceAll(segment, "~", "~0"), "/", "~1"))
+	}
+	return b.String()
+}
+
+// appendSegment returns the segments followed by another segment, without modifying the
+// array of the given segments.
+func appendSegment(segments []string, segment string) []string {
+	return append(segments[:len(segments):len(segments)], segment)
+}
@@ -0,0 +1,42 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePathPatterns(t *testing.T) {
+	patterns := parsePathPatterns("/spec/containers/*/image, /metadata/annotations/app.kubernetes.io~1name, spec/missing-slash, /spec/[")
+	assert.Equal(t, []pathPattern{
+		{"spec", "containers", "*", "image"},
+		{"metadata", "annotations", "app.kubernetes.io/name"},
+	}, patterns)
+}
+
+func TestSplitPointer(t *testing.T) {
+	assert.Equal(t, []string{"metadata", "annotations", "a/b~c"}, splitPointer("/metadata/annotations/a~1b~0c"))
+	assert.Nil(t, splitPointer(""))
+}
+
+func TestPathPatternCovers(t *testing.T) {
+	p, _ := parsePathPattern("/spec/containers/*")
+	assert.True(t, p.covers(splitPointer("/spec/containers/0")))
+	assert.True(t, p.covers(splitPointer("/spec/containers/0/image")))
+	assert.False(t, p.covers(splitPointer("/spec/containers")))
+	assert.True(t, p.overlaps(splitPointer("/spec/containers")))
+}
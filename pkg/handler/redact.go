@@ -0,0 +1,209 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// defaultRedactedEnvNames are the environment variable names whose values are redacted
+// when REDACT_ENV_NAMES is not set.
+const defaultRedactedEnvNames = "*PASSWORD*,*PASSWD*,*TOKEN*,*SECRET*,*API_KEY*,*PRIVATE_KEY*"
+
+// objectRedactor redacts every object before it is cached, diffed, logged or sent.
+var objectRedactor = newRedactor(os.Getenv("REDACTION_SALT"), os.Getenv("REDACT_ENV_NAMES"), os.Getenv("REDACT_PATHS"))
+
+// redactor replaces sensitive values with salted hashes, so that a change of the value is
+// still reported without revealing it. It redacts the data of Secrets, the values of
+// environment variables with sensitive names and the values at the configured paths, in the
+// object as well as in the copy kept by kubectl apply.
+type redactor struct {
+	salt     []byte
+	envNames []string
+	paths    []pathPattern
+}
+
+// newRedactor builds a redactor from a salt and comma-separated environment variable name
+// patterns and path patterns. Without a salt, a random one is used, so hashes are only
+// comparable within a single run of the agent.
+func newRedactor(salt, envNames, paths string) *redactor {
+	r := &redactor{
+		salt:  []byte(salt),
+		paths: parsePathPatterns(paths),
+	}
+	if salt == "" {
+		r.salt = make([]byte, 32)
+		_, _ = rand.Read(r.salt)
+	}
+
+	if strings.TrimSpace(envNames) == "" {
+		envNames = defaultRedactedEnvNames
+	}
+	for _, name := range strings.Split(envNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			r.envNames = append(r.envNames, strings.ToUpper(name))
+		}
+	}
+	return r
+}
+
+// hash returns the salted hash that replaces a value.
+func (r *redactor) hash(value interface{}) string {
+	data, ok := value.(string)
+	if !ok {
+		encoded, _ := json.Marshal(value)
+		data = string(encoded)
+	}
+	mac := hmac.New(sha256.New, r.salt)
+	mac.Write([]byte(data))
+	return "redacted:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// redact redacts the content of an object of the given resource in place.
+func (r *redactor) redact(content map[string]interface{}, gvr schema.GroupVersionResource) {
+	if gvr.Group == "" && gvr.Resource == "secrets" {
+		for _, field := range []string{"data", "stringData"} {
+			if values, ok := content[field].(map[string]interface{}); ok {
+				for key, value := range values {
+					values[key] = r.hash(value)
+				}
+			}
+		}
+	}
+
+	r.redactLastApplied(content, gvr)
+	r.redactEnv(content)
+
+	for _, p := range r.paths {
+		r.redactPath(content, p)
+	}
+}
+
+// redactLastApplied redacts the full copy of the object that kubectl apply keeps in an
+// annotation, of any kind, like the object itself. A copy that cannot be parsed is hashed.
+func (r *redactor) redactLastApplied(content map[string]interface{}, gvr schema.GroupVersionResource) {
+	value, found, _ := unstructured.NestedString(content, "metadata", "annotations", lastAppliedConfigAnnotation)
+	if !found {
+		return
+	}
+
+	redacted := r.hash(value)
+	var applied map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &applied); err == nil && applied != nil {
+		r.redact(applied, gvr)
+		if encoded, err := json.Marshal(applied); err == nil {
+			redacted = string(encoded)
+		}
+	}
+	_ = unstructured.SetNestedField(content, redacted, "metadata", "annotations", lastAppliedConfigAnnotation)
+}
+
+// redactEnv redacts the values of sensitive environment variables anywhere in value,
+// covering the containers of pods as well as of pod templates in workloads.
+func (r *redactor) redactEnv(value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if env, ok := child.([]interface{}); ok && key == "env" {
+				for _, item := range env {
+					if variable, ok := item.(map[string]interface{}); ok {
+						r.redactVariable(variable)
+					}
+				}
+				continue
+			}
+			r.redactEnv(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			r.redactEnv(child)
+		}
+	}
+}
+
+func (r *redactor) redactVariable(variable map[string]interface{}) {
+	name, _ := variable["name"].(string)
+	value, hasValue := variable["value"]
+	if !hasValue {
+		return
+	}
+	for _, pattern := range r.envNames {
+		if matchSegment(pattern, strings.ToUpper(name)) {
+			variable["value"] = r.hash(value)
+			return
+		}
+	}
+}
+
+// redactPath redacts every value matching the remaining segments of a path pattern.
+func (r *redactor) redactPath(value interface{}, pattern pathPattern) {
+	if len(pattern) == 0 {
+		return
+	}
+	last := len(pattern) == 1
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if !matchSegment(pattern[0], key) {
+				continue
+			}
+			if last {
+				v[key] = r.hash(child)
+			} else {
+				r.redactPath(child, pattern[1:])
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if !matchSegment(pattern[0], strconv.Itoa(i)) {
+				continue
+			}
+			if last {
+				v[i] = r.hash(child)
+			} else {
+				r.redactPath(child, pattern[1:])
+			}
+		}
+	}
+}
+
+// Redact returns a copy of obj with sensitive values replaced by salted hashes, as the
+// agent caches and reports it. The copy is unstructured.
+func Redact(obj k8sruntime.Object, gvr schema.GroupVersionResource) (k8sruntime.Unstructured, error) {
+	var content map[string]interface{}
+	if u, ok := obj.(k8sruntime.Unstructured); ok {
+		content = k8sruntime.DeepCopyJSON(u.UnstructuredContent())
+	} else {
+		var err error
+		if content, err = k8sruntime.DefaultUnstructuredConverter.ToUnstructured(obj); err != nil {
+			return nil, err
+		}
+	}
+
+	objectRedactor.redact(content, gvr)
+	return &unstructured.Unstructured{Object: content}, nil
+}
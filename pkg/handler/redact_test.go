@@ -0,0 +1,142 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+var secrets = schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+
+func newSecret(password string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("Secret")
+	obj.SetNamespace("default")
+	obj.SetName("db")
+	obj.SetAnnotations(map[string]string{lastAppliedConfigAnnotation: `{"data":{"password":"` + password + `"}}`})
+	_ = unstructured.SetNestedStringMap(obj.Object, map[string]string{"password": password, "user": "YWRtaW4="}, "data")
+	return obj
+}
+
+func TestRedactSecret(t *testing.T) {
+	r := newRedactor("salt", "", "")
+
+	first, second := newSecret("c2VjcmV0").Object, newSecret("b3RoZXI=").Object
+	r.redact(first, secrets)
+	r.redact(second, secrets)
+
+	password, _, _ := unstructured.NestedString(first, "data", "password")
+	assert.True(t, strings.HasPrefix(password, "redacted:"), "Expected the password to be redacted, got %s", password)
+	otherPassword, _, _ := unstructured.NestedString(second, "data", "password")
+	assert.NotEqual(t, password, otherPassword, "Expected a changed value to get another hash")
+	user, _, _ := unstructured.NestedString(first, "data", "user")
+	otherUser, _, _ := unstructured.NestedString(second, "data", "user")
+	assert.Equal(t, user, otherUser, "Expected an unchanged value to keep its hash")
+
+	annotation, _, _ := unstructured.NestedString(first, "metadata", "annotations", lastAppliedConfigAnnotation)
+	assert.NotContains(t, annotation, "c2VjcmV0")
+
+	// The same value gets another hash with another salt
+	third := newSecret("c2VjcmV0").Object
+	newRedactor("pepper", "", "").redact(third, secrets)
+	saltedPassword, _, _ := unstructured.NestedString(third, "data", "password")
+	assert.NotEqual(t, password, saltedPassword)
+}
+
+func TestRedactEnvAndPaths(t *testing.T) {
+	r := newRedactor("salt", "", "/spec/template/spec/containers/*/args")
+
+	content := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name": "app",
+							"args": []interface{}{"--token=abc"},
+							"env": []interface{}{
+								map[string]interface{}{"name": "DB_PASSWORD", "value": "hunter2"},
+								map[string]interface{}{"name": "github_token", "value": "ghp_123"},
+								map[string]interface{}{"name": "LOG_LEVEL", "value": "debug"},
+								map[string]interface{}{"name": "API_KEY", "valueFrom": map[string]interface{}{"secretKeyRef": map[string]interface{}{"name": "api"}}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	r.redact(content, schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"})
+
+	containers, _, _ := unstructured.NestedSlice(content, "spec", "template", "spec", "containers")
+	container := containers[0].(map[string]interface{})
+	env := container["env"].([]interface{})
+	assert.NotEqual(t, "hunter2", env[0].(map[string]interface{})["value"])
+	assert.NotEqual(t, "ghp_123", env[1].(map[string]interface{})["value"], "Expected names to match regardless of case")
+	assert.Equal(t, "debug", env[2].(map[string]interface{})["value"])
+	assert.NotContains(t, env[3].(map[string]interface{}), "value", "Expected references to be left alone")
+	assert.IsType(t, "", container["args"], "Expected the configured path to be replaced by its hash")
+}
+
+func TestRedactLastAppliedConfiguration(t *testing.T) {
+	r := newRedactor("salt", "", "")
+
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("apps/v1")
+	obj.SetKind("Deployment")
+	obj.SetName("web")
+	obj.SetAnnotations(map[string]string{lastAppliedConfigAnnotation: `{"apiVersion":"apps/v1","kind":"Deployment",` +
+		`"spec":{"template":{"spec":{"containers":[{"name":"app","env":[{"name":"PASSWORD","value":"hunter2"},{"name":"LOG_LEVEL","value":"debug"}]}]}}}}`})
+	r.redact(obj.Object, schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"})
+
+	// The copy kept by kubectl apply is redacted like the object itself
+	annotation := obj.GetAnnotations()[lastAppliedConfigAnnotation]
+	assert.NotContains(t, annotation, "hunter2")
+	assert.Contains(t, annotation, `"value":"redacted:`)
+	assert.Contains(t, annotation, `"value":"debug"`)
+
+	// A copy that is not JSON is replaced by its hash
+	obj.SetAnnotations(map[string]string{lastAppliedConfigAnnotation: "PASSWORD=hunter2"})
+	r.redact(obj.Object, schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"})
+	assert.True(t, strings.HasPrefix(obj.GetAnnotations()[lastAppliedConfigAnnotation], "redacted:"))
+}
+
+func TestHandleEventRedactsSecrets(t *testing.T) {
+	originalExternalSendEnabled := externalSendEnabled
+	externalSendEnabled = true
+	defer func() { externalSendEnabled = originalExternalSendEnabled }()
+
+	sink := &recordingSink{}
+	SetSink(sink)
+	defer SetSink(nil)
+
+	Seed(newSecret("c2VjcmV0"), secrets)
+	HandleEvent(watch.Event{Type: watch.Modified, Object: newSecret("b3RoZXI=")}, secrets)
+
+	if assert.Len(t, sink.messages, 1) {
+		message := sink.messages[0]
+		changes := strings.Join(describeChanges(message.Changes), "\n")
+		assert.Contains(t, changes, "/data/password", "Expected the change to be reported")
+		assert.NotContains(t, changes, "c2VjcmV0")
+		assert.NotContains(t, changes, "b3RoZXI=")
+	}
+}
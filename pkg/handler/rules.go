@@ -0,0 +1,289 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// fieldRules holds the field and expression rules read from FIELD_RULES_FILE.
+var fieldRules = newRuleFile(os.Getenv("FIELD_RULES_FILE"))
+
+// rulesSpec is the content of the rules file, written in YAML or JSON:
+//
+//	rules:
+//	- apiGroups: ["apps"]
+//	  resources: ["deployments"]
+//	  namespaces: ["team-a", "team-a-*"]
+//	  include: ["/spec/replicas", "/spec/template/spec/containers/*/image"]
+//	  exclude: ["/metadata/annotations/deployment.kubernetes.io~1revision"]
+//	expressions:
+//	- resources: ["configmaps"]
+//	  match: '"control-plane.alpha.kubernetes.io/leader" in object.metadata.annotations'
+//	  action: drop
+type rulesSpec struct {
+	Rules       []ruleSpec       `json:"rules"`
+	Expressions []expressionSpec `json:"expressions"`
+}
+
+// scopeSpec scopes a rule to resources and namespaces. Every entry may contain path.Match
+// wildcards and an omitted list matches anything. The core API group is written "". A rule
+// with namespaces does not apply to cluster-scoped objects.
+type scopeSpec struct {
+	APIGroups   []string `json:"apiGroups,omitempty"`
+	APIVersions []string `json:"apiVersions,omitempty"`
+	Resources   []string `json:"resources,omitempty"`
+	Namespaces  []string `json:"namespaces,omitempty"`
+}
+
+// ruleSpec holds include and exclude patterns for the fields of the objects in its scope.
+type ruleSpec struct {
+	scopeSpec
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// ruleSet is a parsed rules file.
+type ruleSet struct {
+	fields      []fieldRule
+	expressions []expressionRule
+}
+
+// fieldRule is a parsed ruleSpec.
+type fieldRule struct {
+	scopeSpec
+	include []pathPattern
+	exclude []pathPattern
+}
+
+// parseRules parses a rules file. Unknown fields, malformed patterns and expressions that do
+// not compile are errors, so a typo does not silently turn a rule off.
+func parseRules(data []byte) (ruleSet, error) {
+	var spec rulesSpec
+	if err := yaml.UnmarshalStrict(data, &spec); err != nil {
+		return ruleSet{}, err
+	}
+
+	rules := ruleSet{fields: make([]fieldRule, 0, len(spec.Rules))}
+	for i, s := range spec.Rules {
+		if err := s.scopeSpec.validate(); err != nil {
+			return ruleSet{}, fmt.Errorf("rule %d: %w", i, err)
+		}
+		include, err := parseRulePatterns(s.Include)
+		if err != nil {
+			return ruleSet{}, fmt.Errorf("rule %d: %w", i, err)
+		}
+		exclude, err := parseRulePatterns(s.Exclude)
+		if err != nil {
+			return ruleSet{}, fmt.Errorf("rule %d: %w", i, err)
+		}
+		rules.fields = append(rules.fields, fieldRule{scopeSpec: s.scopeSpec, include: include, exclude: exclude})
+	}
+	for i, s := range spec.Expressions {
+		if err := s.scopeSpec.validate(); err != nil {
+			return ruleSet{}, fmt.Errorf("expression %d: %w", i, err)
+		}
+		rule, err := compileExpressionRule(s)
+		if err != nil {
+			return ruleSet{}, fmt.Errorf("expression %d: %w", i, err)
+		}
+		rules.expressions = append(rules.expressions, rule)
+	}
+	return rules, nil
+}
+
+// validate checks that every entry of the scope is a valid pattern.
+func (s scopeSpec) validate() error {
+	for _, list := range [][]string{s.APIGroups, s.APIVersions, s.Resources, s.Namespaces} {
+		for _, entry := range list {
+			if _, err := path.Match(entry, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q", entry)
+			}
+		}
+	}
+	return nil
+}
+
+func parseRulePatterns(specs []string) ([]pathPattern, error) {
+	patterns := make([]pathPattern, 0, len(specs))
+	for _, spec := range specs {
+		p, ok := parsePathPattern(spec)
+		if !ok {
+			return nil, fmt.Errorf("invalid path pattern %q", spec)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// appliesTo reports whether a rule with the scope applies to an object of a resource in a namespace.
+func (s scopeSpec) appliesTo(gvr schema.GroupVersionResource, namespace string) bool {
+	if len(s.Namespaces) > 0 && namespace == "" {
+		return false
+	}
+	return matchAny(s.APIGroups, gvr.Group) && matchAny(s.APIVersions, gvr.Version) &&
+		matchAny(s.Resources, gvr.Resource) && matchAny(s.Namespaces, namespace)
+}
+
+// matchAny reports whether the value matches one of the patterns, or whether there are none.
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if matchSegment(p, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldFilter holds the rules that apply to an object.
+type fieldFilter []fieldRule
+
+// keeps reports whether a change of the field at the given pointer segments is reported. A
+// field is dropped if it is, or is contained by, an excluded field. If any rule has include
+// patterns, the field must be, contain or be contained by an included field.
+func (f fieldFilter) keeps(segments []string) bool {
+	for _, r := range f {
+		for _, p := range r.exclude {
+			if p.covers(segments) {
+				return false
+			}
+		}
+	}
+
+	included := true
+	for _, r := range f {
+		if len(r.include) == 0 {
+			continue
+		}
+		included = false
+		for _, p := range r.include {
+			if p.overlaps(segments) {
+				return true
+			}
+		}
+	}
+	return included
+}
+
+// rulesReloadInterval is how often the rules file is checked for changes.
+const rulesReloadInterval = 10 * time.Second
+
+// ruleFile reads the rules from a file, typically a mounted config map, and reads them again
+// in the background whenever the file changes so that rules can be tuned without a restart.
+// If the file cannot be parsed, the previous rules are kept. Events only load the current
+// rules, so they never wait on the file system.
+type ruleFile struct {
+	path     string
+	interval time.Duration // Zero disables the background reload
+
+	start sync.Once
+	rules atomic.Pointer[ruleSet]
+
+	// Only used by reload
+	modTime time.Time
+	size    int64
+}
+
+func newRuleFile(path string) *ruleFile {
+	return &ruleFile{path: path, interval: rulesReloadInterval}
+}
+
+// current returns the rules. The first call reads the file and starts the background reload.
+func (f *ruleFile) current() ruleSet {
+	if f.path == "" {
+		return ruleSet{}
+	}
+
+	f.start.Do(func() {
+		f.reload()
+		if f.interval > 0 {
+			go f.reloadLoop()
+		}
+	})
+	if rules := f.rules.Load(); rules != nil {
+		return *rules
+	}
+	return ruleSet{}
+}
+
+func (f *ruleFile) reloadLoop() {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		f.reload()
+	}
+}
+
+// reload reads the file again if it changed. It must not be called concurrently.
+func (f *ruleFile) reload() {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		debugLog("Error reading field rules: %v", err)
+		return
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return
+	}
+
+	// Remember the version even if it is invalid, so the error is only logged once
+	f.modTime, f.size = info.ModTime(), info.Size()
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		log.Printf("Error reading field rules from %s: %v", f.path, err)
+		return
+	}
+	rules, err := parseRules(data)
+	if err != nil {
+		log.Printf("Ignoring invalid field rules in %s, keeping the previous rules: %v", f.path, err)
+		return
+	}
+	log.Printf("Loaded %d field rules and %d expression rules from %s", len(rules.fields), len(rules.expressions), f.path)
+	f.rules.Store(&rules)
+}
+
+// forObject returns the field rules that apply to an object of a resource in a namespace.
+func (f *ruleFile) forObject(gvr schema.GroupVersionResource, namespace string) fieldFilter {
+	var filter fieldFilter
+	for _, r := range f.current().fields {
+		if r.appliesTo(gvr, namespace) {
+			filter = append(filter, r)
+		}
+	}
+	return filter
+}
+
+// expressionsFor returns the expression rules that apply to an object of a resource in a
+// namespace, in the order they are written.
+func (f *ruleFile) expressionsFor(gvr schema.GroupVersionResource, namespace string) []expressionRule {
+	var rules []expressionRule
+	for _, r := range f.current().expressions {
+		if r.appliesTo(gvr, namespace) {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
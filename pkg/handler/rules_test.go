@@ -0,0 +1,124 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const testRules = `
+rules:
+- apiGroups: ["apps"]
+  resources: ["deployments"]
+  namespaces: ["team-a-*"]
+  include: ["/spec/replicas", "/spec/template/spec/containers/*/image"]
+- resources: ["*"]
+  exclude: ["/metadata/annotations/deployment.kubernetes.io~1revision"]
+`
+
+func TestParseRules(t *testing.T) {
+	rules, err := parseRules([]byte(testRules))
+	assert.NoError(t, err)
+	assert.Len(t, rules.fields, 2)
+	assert.Equal(t, []pathPattern{{"spec", "replicas"}, {"spec", "template", "spec", "containers", "*", "image"}}, rules.fields[0].include)
+
+	_, err = parseRules([]byte("rules:\n- resource: [pods]\n"))
+	assert.Error(t, err, "Unknown fields should be rejected")
+	_, err = parseRules([]byte("rules:\n- include: [spec/replicas]\n"))
+	assert.Error(t, err, "Malformed patterns should be rejected")
+}
+
+func TestFieldRuleAppliesTo(t *testing.T) {
+	rules, _ := parseRules([]byte(testRules))
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	pods := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+	assert.True(t, rules.fields[0].appliesTo(deployments, "team-a-web"))
+	assert.False(t, rules.fields[0].appliesTo(deployments, "team-b"))
+	assert.False(t, rules.fields[0].appliesTo(deployments, ""))
+	assert.False(t, rules.fields[0].appliesTo(pods, "team-a-web"))
+	assert.True(t, rules.fields[1].appliesTo(pods, ""))
+}
+
+func TestFieldFilterKeeps(t *testing.T) {
+	rules, _ := parseRules([]byte(testRules))
+	filter := fieldFilter(rules.fields)
+
+	assert.True(t, filter.keeps(splitPointer("/spec/replicas")))
+	assert.True(t, filter.keeps(splitPointer("/spec/template/spec/containers/0/image")))
+	// Adding a whole container contains an included field
+	assert.True(t, filter.keeps(splitPointer("/spec/template/spec/containers/1")))
+	assert.False(t, filter.keeps(splitPointer("/spec/template/spec/containers/0/args")))
+	assert.False(t, filter.keeps(splitPointer("/metadata/annotations/deployment.kubernetes.io~1revision")))
+
+	// Without include patterns, everything that is not excluded is kept
+	filter = fieldFilter(rules.fields[1:])
+	assert.True(t, filter.keeps(splitPointer("/spec/template/spec/containers/0/args")))
+	assert.False(t, filter.keeps(splitPointer("/metadata/annotations/deployment.kubernetes.io~1revision")))
+	assert.True(t, fieldFilter(nil).keeps(splitPointer("/spec/replicas")))
+}
+
+func TestRuleFileReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(file, []byte(testRules), 0o600); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+	rules := &ruleFile{path: file}
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	assert.Len(t, rules.forObject(deployments, "team-a-web"), 2)
+
+	// Changes are only picked up by a reload
+	if err := os.WriteFile(file, []byte("rules: [invalid"), 0o600); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+	assert.Len(t, rules.forObject(deployments, "team-a-web"), 2)
+
+	// An invalid file keeps the previous rules
+	rules.reload()
+	assert.Len(t, rules.forObject(deployments, "team-a-web"), 2)
+
+	if err := os.WriteFile(file, []byte("rules:\n- resources: [pods]\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+	rules.reload()
+	assert.Empty(t, rules.forObject(deployments, "team-a-web"))
+	assert.Len(t, rules.current().fields, 1)
+
+	assert.Empty(t, (&ruleFile{}).current().fields)
+}
+
+func TestDiffAndLogFieldRules(t *testing.T) {
+	oldObj := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Labels: map[string]string{"app": "web"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "v1"}}},
+	}
+	newObj := oldObj.DeepCopy()
+	newObj.Labels["app"] = "api"
+	newObj.Spec.Containers[0].Image = "v2"
+
+	rules, _ := parseRules([]byte("rules:\n- include: [/spec/containers/*/image]\n"))
+	changes, _ := diffAndLog(oldObj, newObj, "default/test-pod", nil, fieldFilter(rules.fields))
+	assert.Equal(t, map[string]interface{}{
+		"/spec/containers/name=app/image": map[string]interface{}{"op": "replace", "old": "v1", "new": "v2",
+			"identity": "/spec/containers/name=app/image", "path": "/spec/containers/0/image"},
+	}, changes)
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// Categories of the changes of a MODIFIED event.
+const (
+	CategorySpec   = "spec"
+	CategoryStatus = "status"
+)
+
+// defaultStatusPaths are the status fields reported per kind. Fields that change on
+// every heartbeat, such as probe or transition times, are left out on purpose.
+var defaultStatusPaths = map[string][]string{
+	"Pod": {
+		"/status/phase",
+		"/status/reason",
+		"/status/conditions/*/status",
+		"/status/containerStatuses/*/ready",
+		"/status/containerStatuses/*/restartCount",
+		"/status/containerStatuses/*/state/*/reason",
+		"/status/containerStatuses/*/lastState/terminated/reason",
+		"/status/containerStatuses/*/lastState/terminated/exitCode",
+		"/status/initContainerStatuses/*/ready",
+		"/status/initContainerStatuses/*/restartCount",
+		"/status/initContainerStatuses/*/state/*/reason",
+	},
+	"Deployment": {
+		"/status/replicas",
+		"/status/readyReplicas",
+		"/status/availableReplicas",
+		"/status/unavailableReplicas",
+		"/status/updatedReplicas",
+		"/status/conditions/*/status",
+		"/status/conditions/*/reason",
+	},
+	"StatefulSet": {
+		"/status/replicas",
+		"/status/readyReplicas",
+		"/status/availableReplicas",
+		"/status/currentReplicas",
+		"/status/updatedReplicas",
+	},
+	"DaemonSet": {
+		"/status/desiredNumberScheduled",
+		"/status/numberReady",
+		"/status/numberAvailable",
+		"/status/numberUnavailable",
+		"/status/numberMisscheduled",
+	},
+	"Job": {
+		"/status/active",
+		"/status/succeeded",
+		"/status/failed",
+		"/status/conditions/*/type",
+		"/status/conditions/*/status",
+	},
+	"CronJob": {
+		"/status/active",
+	},
+	"PersistentVolumeClaim": {
+		"/status/phase",
+	},
+	"Service": {
+		"/status/loadBalancer/ingress",
+	},
+	"Ingress": {
+		"/status/loadBalancer/ingress",
+	},
+}
+
+// statusAllowlist holds the status fields reported per kind, read from the defaults and
+// STATUS_PATHS. Status changes are not reported at all if STATUS_EVENTS_ENABLED is false.
+var statusAllowlist = newStatusAllowlist(os.Getenv("STATUS_EVENTS_ENABLED") != "false", os.Getenv("STATUS_PATHS"))
+
+// newStatusAllowlist builds the allowlist from the defaults and comma-separated extra
+// entries written as Kind:/pointer, where the kind "*" applies to every kind.
+func newStatusAllowlist(enabled bool, extra string) map[string][]pathPattern {
+	allowlist := make(map[string][]pathPattern)
+	if !enabled {
+		return allowlist
+	}
+
+	for kind, specs := range defaultStatusPaths {
+		allowlist[kind] = parsePathPatterns(strings.Join(specs, ","))
+	}
+	for _, entry := range strings.Split(extra, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kind, spec, found := strings.Cut(entry, ":")
+		p, ok := parsePathPattern(spec)
+		if !found || kind == "" || !ok {
+			log.Printf("Ignoring invalid status path %q", entry)
+			continue
+		}
+		allowlist[kind] = append(allowlist[kind], p)
+	}
+	return allowlist
+}
+
+// statusPaths returns the status fields reported for a kind.
+func statusPaths(kind string) []pathPattern {
+	paths := make([]pathPattern, 0, len(statusAllowlist[kind])+len(statusAllowlist["*"]))
+	paths = append(paths, statusAllowlist[kind]...)
+	return append(paths, statusAllowlist["*"]...)
+}
+
+// filterStatusPatch keeps the operations on the allowlisted status fields. An operation on a
+// parent of an allowlisted field, such as a condition being added, is kept as well.
+func filterStatusPatch(patch []fieldDiff, paths []pathPattern) []fieldDiff {
+	var filteredPatch []fieldDiff
+	for _, op := range patch {
+		segments := splitPointer(op.path)
+		if len(segments) == 0 || segments[0] != "status" {
+			continue
+		}
+		for _, p := range paths {
+			if p.overlaps(segments) {
+				filteredPatch = append(filteredPatch, op)
+				break
+			}
+		}
+	}
+	return filteredPatch
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+
+	eventpb "github.com/incidentassistant/k8s-agent/proto/event"
+)
+
+func TestFilterStatusPatch(t *testing.T) {
+	patch := []fieldDiff{
+		{op: "replace", path: "/status/phase", newValue: "Failed"},
+		{op: "replace", path: "/status/conditions/0/lastTransitionTime", newValue: "2024-01-01T00:00:00Z"},
+		{op: "replace", path: "/status/conditions/0/status", newValue: "False"},
+		{op: "add", path: "/status/conditions/1", newValue: map[string]interface{}{"type": "Ready"}},
+		{op: "replace", path: "/spec/replicas", newValue: 1},
+	}
+
+	filtered := filterStatusPatch(patch, statusPaths("Pod"))
+	var paths []string
+	for _, op := range filtered {
+		paths = append(paths, op.path)
+	}
+	assert.Equal(t, []string{"/status/phase", "/status/conditions/0/status", "/status/conditions/1"}, paths)
+
+	assert.Empty(t, filterStatusPatch(patch, statusPaths("UnknownKind")))
+}
+
+func TestNewStatusAllowlist(t *testing.T) {
+	allowlist := newStatusAllowlist(true, "Widget:/status/health, *:/status/ready, invalid, Widget:status")
+	assert.Equal(t, []pathPattern{{"status", "health"}}, allowlist["Widget"])
+	assert.Equal(t, []pathPattern{{"status", "ready"}}, allowlist["*"])
+	assert.NotEmpty(t, allowlist["Deployment"])
+
+	assert.Empty(t, newStatusAllowlist(false, "Widget:/status/health"))
+}
+
+func TestHandleEventStatusChanges(t *testing.T) {
+	originalExternalSendEnabled := externalSendEnabled
+	externalSendEnabled = true
+	defer func() { externalSendEnabled = originalExternalSendEnabled }()
+
+	sink := &recordingSink{}
+	SetSink(sink)
+	defer SetSink(nil)
+
+	gvr := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("apps/v1")
+	obj.SetKind("Deployment")
+	obj.SetNamespace("status-test")
+	obj.SetName("web")
+	_ = unstructured.SetNestedField(obj.Object, int64(3), "spec", "replicas")
+	_ = unstructured.SetNestedField(obj.Object, int64(3), "status", "readyReplicas")
+	_ = unstructured.SetNestedField(obj.Object, int64(7), "status", "observedGeneration")
+	Seed(obj, gvr)
+
+	// Only a status field that is not allowlisted changes
+	noisy := obj.DeepCopy()
+	_ = unstructured.SetNestedField(noisy.Object, int64(8), "status", "observedGeneration")
+	HandleEvent(watch.Event{Type: watch.Modified, Object: noisy}, gvr)
+	assert.Empty(t, sink.messages)
+
+	// The spec and the status change together
+	updated := noisy.DeepCopy()
+	_ = unstructured.SetNestedField(updated.Object, int64(5), "spec", "replicas")
+	_ = unstructured.SetNestedField(updated.Object, int64(2), "status", "readyReplicas")
+	_ = unstructured.SetNestedField(updated.Object, int64(1), "status", "unavailableReplicas")
+	HandleEvent(watch.Event{Type: watch.Modified, Object: updated}, gvr)
+
+	if assert.Len(t, sink.messages, 2) {
+		spec, status := sink.messages[0], sink.messages[1]
+		assert.Equal(t, CategorySpec, spec.Category)
+		assert.Equal(t, []string{"OP_REPLACE /spec/replicas 3 5"}, describeChanges(spec.Changes))
+
+		assert.Equal(t, CategoryStatus, status.Category)
+		assert.Equal(t, string(watch.Modified), status.EventType)
+		assert.Equal(t, []string{"OP_REPLACE /status/readyReplicas 3 2", "OP_ADD /status/unavailableReplicas  1"}, describeChanges(status.Changes))
+		if assert.Len(t, status.Changes, 2) {
+			assert.Equal(t, eventpb.FieldChange_OP_REPLACE, status.Changes[0].Op)
+			assert.Equal(t, eventpb.FieldChange_OP_ADD, status.Changes[1].Op)
+			assert.Empty(t, status.Changes[1].Old)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Status is the state reported by a single component of the agent.
+type Status struct {
+	// Degraded is set when the component works but with reduced coverage.
+	Degraded bool `json:"degraded"`
+	// Details describes the state, e.g. which API groups or resources are failing.
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Checker returns the current status of a component.
+type Checker func() Status
+
+// Report is the JSON document served by the health endpoints.
+type Report struct {
+	Status     string            `json:"status"`
+	Components map[string]Status `json:"components"`
+}
+
+var (
+	mu       sync.RWMutex
+	checkers = make(map[string]Checker)
+	ready    = func() bool { return true }
+)
+
+// Register adds a named component to the health report.
+func Register(name string, check Checker) {
+	mu.Lock()
+	defer mu.Unlock()
+	checkers[name] = check
+}
+
+// SetReadiness sets the function that decides whether the agent is ready.
+func SetReadiness(isReady func() bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	ready = isReady
+}
+
+// Collect runs every registered checker and builds the current report.
+// The overall status is "degraded" if any component is degraded, "ok" otherwise.
+func Collect() Report {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(checkers))
+	for name := range checkers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report := Report{Status: "ok", Components: make(map[string]Status, len(checkers))}
+	for _, name := range names {
+		status := checkers[name]()
+		if status.Degraded {
+			report.Status = "degraded"
+		}
+		report.Components[name] = status
+	}
+	return report
+}
+
+// Handler serves /healthz and /readyz. /healthz always answers 200 with the report, since
+// a degraded agent still provides partial coverage and restarting it would not help.
+// /readyz answers 503 until the readiness function reports the agent ready.
+// Counters published with expvar are served on /debug/vars.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, http.StatusOK, Collect())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		mu.RLock()
+		isReady := ready
+		mu.RUnlock()
+
+		code := http.StatusOK
+		if !isReady() {
+			code = http.StatusServiceUnavailable
+		}
+		writeReport(w, code, Collect())
+	})
+	return mux
+}
+
+// ListenAndServe serves the health endpoints on addr. Errors are logged, not fatal,
+// so a port conflict does not take down event collection.
+func ListenAndServe(addr string) {
+	log.Printf("Serving health endpoints on %s", addr)
+	if err := http.ListenAndServe(addr, Handler()); err != nil {
+		log.Printf("Health server stopped: %v", err)
+	}
+}
+
+func writeReport(w http.ResponseWriter, code int, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("Error writing health report: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	degraded := false
+	isReady := false
+	Register("discovery", func() Status {
+		return Status{Degraded: degraded, Details: map[string]string{"metrics.k8s.io/v1beta1": "unavailable"}}
+	})
+	SetReadiness(func() bool { return isReady })
+
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	get := func(path string) (int, Report) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		var report Report
+		if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			t.Fatalf("Failed to decode report: %v", err)
+		}
+		return resp.StatusCode, report
+	}
+
+	if code, report := get("/healthz"); code != http.StatusOK || report.Status != "ok" {
+		t.Fatalf("Expected healthy report, got %d %+v", code, report)
+	}
+	if code, _ := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected /readyz to fail before the agent is ready, got %d", code)
+	}
+
+	degraded, isReady = true, true
+	code, report := get("/healthz")
+	if code != http.StatusOK || report.Status != "degraded" || !report.Components["discovery"].Degraded {
+		t.Fatalf("Expected degraded report with status 200, got %d %+v", code, report)
+	}
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Fatalf("Expected /readyz to succeed once ready, got %d", code)
+	}
+}
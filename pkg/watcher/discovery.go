@@ -0,0 +1,212 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+)
+
+// discoveryRefreshInterval controls how often discovery is re-run to pick up
+// resources installed or removed after startup. It is read from DISCOVERY_REFRESH_INTERVAL.
+var discoveryRefreshInterval = parseRefreshInterval(os.Getenv("DISCOVERY_REFRESH_INTERVAL"))
+
+const (
+	defaultDiscoveryRefreshInterval = time.Minute
+	// discoveryRetryInterval is used instead of the refresh interval while some API groups fail discovery.
+	discoveryRetryInterval = 15 * time.Second
+)
+
+// failedGroups records the API group versions whose discovery failed in the last attempt.
+var failedGroups = newGroupFailures()
+
+type groupFailures struct {
+	mu     sync.RWMutex
+	groups map[schema.GroupVersion]error
+}
+
+func newGroupFailures() *groupFailures {
+	return &groupFailures{groups: make(map[schema.GroupVersion]error)}
+}
+
+func (f *groupFailures) set(groups map[schema.GroupVersion]error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.groups = groups
+}
+
+func (f *groupFailures) has(gv schema.GroupVersion) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	_, ok := f.groups[gv]
+	return ok
+}
+
+func (f *groupFailures) snapshot() map[string]string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	groups := make(map[string]string, len(f.groups))
+	for gv, err := range f.groups {
+		groups[gv.String()] = err.Error()
+	}
+	return groups
+}
+
+// FailedDiscoveryGroups returns the API group versions that could not be discovered in the
+// last attempt, with their errors. Resources in these groups are not watched until they resolve.
+func FailedDiscoveryGroups() map[string]string {
+	return failedGroups.snapshot()
+}
+
+// activeWatches holds the stop channel of every running resource watch.
+var (
+	watchesMu     sync.Mutex
+	activeWatches = make(map[schema.GroupVersionResource]chan struct{})
+)
+
+func parseRefreshInterval(value string) time.Duration {
+	if value == "" {
+		return defaultDiscoveryRefreshInterval
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		log.Printf("Invalid DISCOVERY_REFRESH_INTERVAL %q, using %s", value, defaultDiscoveryRefreshInterval)
+		return defaultDiscoveryRefreshInterval
+	}
+	return interval
+}
+
+// discoverWatchableResources discovers the server-supported API resources and returns
+// those that can be listed and watched and are selected by the configured patterns.
+// When only some API groups fail (commonly an unavailable aggregated API such as
+// metrics.k8s.io), the resources of the other groups are returned and the failed
+// groups are recorded; an error is only returned if discovery failed entirely.
+func discoverWatchableResources(discoveryClient discovery.DiscoveryInterface) ([]schema.GroupVersionResource, error) {
+	apiResourceList, err := discoveryClient.ServerPreferredResources()
+	if err != nil {
+		groups, partial := discovery.GroupDiscoveryFailedErrorGroups(err)
+		if !partial {
+			return nil, err
+		}
+		for gv, groupErr := range groups {
+			log.Printf("Failed to discover resources of %s: %v", gv, groupErr)
+		}
+		failedGroups.set(groups)
+	} else {
+		failedGroups.set(make(map[schema.GroupVersion]error))
+	}
+
+	return filterWatchableResources(
+		discovery.FilteredBy(discovery.SupportsAllVerbs{Verbs: []string{"list", "watch"}}, apiResourceList)), nil
+}
+
+// refreshWatches periodically re-runs discovery and reconciles the running watches with the result.
+// While some API groups fail discovery they are retried every discoveryRetryInterval.
+func refreshWatches(client dynamic.Interface, discoveryClient discovery.DiscoveryInterface, interval time.Duration) {
+	for {
+		next := interval
+		if len(FailedDiscoveryGroups()) > 0 && discoveryRetryInterval < next {
+			next = discoveryRetryInterval
+		}
+		time.Sleep(next)
+
+		watchableResources, err := discoverWatchableResources(discoveryClient)
+		if err != nil {
+			log.Printf("Failed to refresh server-supported API resources: %v", err)
+			continue
+		}
+
+		added, removed := reconcileWatches(client, watchableResources)
+		for _, gvr := range added {
+			log.Printf("Discovered new resource %s", gvr)
+		}
+		for _, gvr := range removed {
+			log.Printf("Resource %s is no longer served", gvr)
+		}
+	}
+}
+
+// reconcileWatches starts a watch for every wanted resource that is not watched yet and
+// stops the watches of resources that are no longer served. It returns what changed.
+func reconcileWatches(client dynamic.Interface, wanted []schema.GroupVersionResource) (added, removed []schema.GroupVersionResource) {
+	watchesMu.Lock()
+	defer watchesMu.Unlock()
+
+	wantedSet := make(map[schema.GroupVersionResource]struct{}, len(wanted))
+	for _, gvr := range wanted {
+		wantedSet[gvr] = struct{}{}
+	}
+
+	for gvr, stopCh := range activeWatches {
+		if _, ok := wantedSet[gvr]; ok {
+			continue
+		}
+		// A resource missing because its group failed discovery is most likely still
+		// served, so keep watching it until discovery says otherwise
+		if failedGroups.has(gvr.GroupVersion()) {
+			continue
+		}
+		close(stopCh)
+		delete(activeWatches, gvr)
+		syncStatus.untrack(gvr)
+		forgetObjects(gvr)
+		removed = append(removed, gvr)
+	}
+
+	// Forget the status of resources given up on that are no longer served either
+	for gvr := range syncStatus.resources() {
+		_, isWanted := wantedSet[gvr]
+		_, isActive := activeWatches[gvr]
+		if !isWanted && !isActive && !failedGroups.has(gvr.GroupVersion()) {
+			syncStatus.untrack(gvr)
+		}
+	}
+
+	for _, gvr := range wanted {
+		if _, ok := activeWatches[gvr]; ok {
+			continue
+		}
+		stopCh := make(chan struct{})
+		activeWatches[gvr] = stopCh
+		syncStatus.track(gvr)
+		go watchResource(client, gvr, stopCh)
+		added = append(added, gvr)
+	}
+
+	return added, removed
+}
+
+// forgetWatch drops a resource whose watch stopped on its own, so that a later
+// discovery refresh starts it again if the resource is still served.
+func forgetWatch(gvr schema.GroupVersionResource) {
+	stopWatch(gvr)
+	syncStatus.untrack(gvr)
+}
+
+// stopWatch drops a resource whose watch stopped on its own like forgetWatch, but keeps
+// reporting its status until a later discovery refresh starts it again. Its cached objects,
+// which are not kept up to date anymore, are evicted.
+func stopWatch(gvr schema.GroupVersionResource) {
+	watchesMu.Lock()
+	delete(activeWatches, gvr)
+	watchesMu.Unlock()
+	forgetObjects(gvr)
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	discoveryfake "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// fakeDiscovery serves a fixed result from ServerPreferredResources, which the
+// client-go fake leaves unimplemented.
+type fakeDiscovery struct {
+	*discoveryfake.FakeDiscovery
+	resources []*metav1.APIResourceList
+	err       error
+}
+
+func (d *fakeDiscovery) ServerPreferredResources() ([]*metav1.APIResourceList, error) {
+	return d.resources, d.err
+}
+
+func newFakeDiscovery(resources []*metav1.APIResourceList, err error) *fakeDiscovery {
+	return &fakeDiscovery{
+		FakeDiscovery: &discoveryfake.FakeDiscovery{Fake: &clienttesting.Fake{}},
+		resources:     resources,
+		err:           err,
+	}
+}
+
+func TestDiscoverWatchableResources(t *testing.T) {
+	discoveryClient := newFakeDiscovery([]*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "pods", Kind: "Pod", Namespaced: true, Verbs: metav1.Verbs{"get", "list", "watch"}},
+				{Name: "bindings", Kind: "Binding", Namespaced: true, Verbs: metav1.Verbs{"create"}},
+			},
+		},
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "deployments", Kind: "Deployment", Namespaced: true, Verbs: metav1.Verbs{"get", "list", "watch"}},
+			},
+		},
+	}, nil)
+
+	resources, err := discoverWatchableResources(discoveryClient)
+	if err != nil {
+		t.Fatalf("discoverWatchableResources returned an error: %v", err)
+	}
+	if len(resources) != 2 {
+		t.Fatalf("Expected pods and deployments, got %v", resources)
+	}
+}
+
+func TestDiscoverWatchableResourcesPartialFailure(t *testing.T) {
+	metrics := schema.GroupVersion{Group: "metrics.k8s.io", Version: "v1beta1"}
+	discoveryClient := newFakeDiscovery([]*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "pods", Kind: "Pod", Namespaced: true, Verbs: metav1.Verbs{"get", "list", "watch"}},
+			},
+		},
+	}, &discovery.ErrGroupDiscoveryFailed{Groups: map[schema.GroupVersion]error{
+		metrics: errors.New("the server is currently unable to handle the request"),
+	}})
+	defer failedGroups.set(make(map[schema.GroupVersion]error))
+
+	resources, err := discoverWatchableResources(discoveryClient)
+	if err != nil {
+		t.Fatalf("Expected partial discovery to succeed, got %v", err)
+	}
+	if len(resources) != 1 || resources[0].Resource != "pods" {
+		t.Fatalf("Expected the resolved pods resource, got %v", resources)
+	}
+	if _, failed := FailedDiscoveryGroups()[metrics.String()]; !failed {
+		t.Fatalf("Expected %s to be recorded as failed, got %v", metrics, FailedDiscoveryGroups())
+	}
+
+	// A complete failure is still an error
+	discoveryClient.resources, discoveryClient.err = nil, errors.New("connection refused")
+	if _, err := discoverWatchableResources(discoveryClient); err == nil {
+		t.Fatal("Expected an error when discovery fails entirely")
+	}
+}
+
+func TestReconcileWatches(t *testing.T) {
+	pods := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	services := schema.GroupVersionResource{Version: "v1", Resource: "services"}
+	configMaps := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		pods:       "PodList",
+		services:   "ServiceList",
+		configMaps: "ConfigMapList",
+	})
+	recordEvents(t)
+	defer reconcileWatches(client, nil)
+	var forgotten []schema.GroupVersionResource
+	originalForget := forgetObjects
+	forgetObjects = func(gvr schema.GroupVersionResource) { forgotten = append(forgotten, gvr) }
+	defer func() { forgetObjects = originalForget }()
+
+	added, removed := reconcileWatches(client, []schema.GroupVersionResource{pods, services})
+	if len(added) != 2 || len(removed) != 0 {
+		t.Fatalf("Expected 2 added and 0 removed, got %v and %v", added, removed)
+	}
+
+	added, removed = reconcileWatches(client, []schema.GroupVersionResource{services, configMaps})
+	if len(added) != 1 || added[0] != configMaps {
+		t.Fatalf("Expected configmaps to be added, got %v", added)
+	}
+	if len(removed) != 1 || removed[0] != pods {
+		t.Fatalf("Expected pods to be removed, got %v", removed)
+	}
+	if _, tracked := SyncStatus()[pods.String()]; tracked {
+		t.Fatal("Expected pods to no longer be reported in the sync status")
+	}
+	if len(forgotten) != 1 || forgotten[0] != pods {
+		t.Fatalf("Expected the cached pods to be evicted, got %v", forgotten)
+	}
+
+	// Resources of a group that failed discovery keep being watched
+	failedGroups.set(map[schema.GroupVersion]error{services.GroupVersion(): errors.New("unavailable")})
+	defer failedGroups.set(make(map[schema.GroupVersion]error))
+	if _, removed = reconcileWatches(client, []schema.GroupVersionResource{configMaps}); len(removed) != 0 {
+		t.Fatalf("Expected services to be kept while their group fails discovery, got %v removed", removed)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !HasSynced() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !HasSynced() {
+		t.Fatalf("Expected the remaining watches to sync, got %v", SyncStatus())
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// defaultWatchedResources is the resource set watched when WATCH_RESOURCES is not set. Every
+// entry names its group, so that custom resources of the same name, e.g. the services of
+// Knative or the gateways of Istio, are not watched along with them.
+const defaultWatchedResources = "pods.core,services.core,configmaps.core,secrets.core,persistentvolumeclaims.core," +
+	"deployments.apps,statefulsets.apps,daemonsets.apps,jobs.batch,cronjobs.batch," +
+	"ingresses.networking.k8s.io,networkpolicies.networking.k8s.io," +
+	"roles.rbac.authorization.k8s.io,rolebindings.rbac.authorization.k8s.io," +
+	"clusterroles.rbac.authorization.k8s.io,clusterrolebindings.rbac.authorization.k8s.io"
+
+// coreGroup is how the core API group, whose name is empty, is written in patterns.
+const coreGroup = "core"
+
+// resourceSelector decides which discovered resources are watched, based on
+// include and exclude patterns read from WATCH_RESOURCES and WATCH_EXCLUDE_RESOURCES.
+var resourceSelector = newResourceSelector(os.Getenv("WATCH_RESOURCES"), os.Getenv("WATCH_EXCLUDE_RESOURCES"))
+
+// resourcePattern matches a group/version/resource. Patterns are written as
+// resource[.group][/version], e.g. "pods", "deployments.apps", "*.argoproj.io" or
+// "virtualservices.networking.istio.io/v1beta1". Each part may contain path.Match
+// wildcards; an omitted group or version matches any, and the core group is written "core",
+// e.g. "services.core". A group starting with "*." matches
+// any subdomain, however deep, so "*.*.istio.io" matches the resources of both
+// networking.istio.io and foo.security.istio.io.
+type resourcePattern struct {
+	resource string
+	group    string
+	version  string
+}
+
+// parseResourcePattern parses a single pattern, returning false if it is malformed.
+func parseResourcePattern(spec string) (resourcePattern, bool) {
+	var p resourcePattern
+
+	rest := spec
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest, p.version = rest[:i], rest[i+1:]
+		if p.version == "" {
+			return p, false
+		}
+	}
+	p.resource, p.group, _ = strings.Cut(rest, ".")
+	if p.resource == "" {
+		return p, false
+	}
+
+	// Reject patterns path.Match cannot evaluate, so they are reported once at startup
+	for _, part := range []string{p.resource, p.group, p.version} {
+		if _, err := path.Match(part, ""); err != nil {
+			return p, false
+		}
+	}
+	return p, true
+}
+
+// matches reports whether the pattern matches the given resource.
+func (p resourcePattern) matches(gvr schema.GroupVersionResource) bool {
+	if ok, _ := path.Match(p.resource, gvr.Resource); !ok {
+		return false
+	}
+	if p.group == coreGroup {
+		if gvr.Group != "" {
+			return false
+		}
+	} else if p.group != "" && !matchGroup(p.group, gvr.Group) {
+		return false
+	}
+	if p.version != "" {
+		if ok, _ := path.Match(p.version, gvr.Version); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// matchGroup reports whether a group matches a pattern. Since the path.Match "*" does not
+// match dots, a leading "*." is matched against the group suffix by suffix.
+func matchGroup(pattern, group string) bool {
+	if ok, _ := path.Match(pattern, group); ok {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(pattern, "*.")
+	if !ok {
+		return false
+	}
+	for i := strings.Index(group, "."); i >= 0; i = strings.Index(group, ".") {
+		group = group[i+1:]
+		if ok, _ := path.Match(suffix, group); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseResourcePatterns parses a comma-separated list of patterns, skipping malformed entries.
+func parseResourcePatterns(specs string) []resourcePattern {
+	var patterns []resourcePattern
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		p, ok := parseResourcePattern(spec)
+		if !ok {
+			log.Printf("Ignoring invalid resource pattern %q", spec)
+			continue
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+// selector holds the include and exclude patterns for watched resources.
+type selector struct {
+	include []resourcePattern
+	exclude []resourcePattern
+}
+
+// newResourceSelector builds a selector from comma-separated include and exclude
+// patterns. An empty include list falls back to the default resource set.
+func newResourceSelector(include, exclude string) *selector {
+	if strings.TrimSpace(include) == "" {
+		include = defaultWatchedResources
+	}
+	return &selector{
+		include: parseResourcePatterns(include),
+		exclude: parseResourcePatterns(exclude),
+	}
+}
+
+// selects reports whether a resource matches an include pattern and no exclude pattern.
+func (s *selector) selects(gvr schema.GroupVersionResource) bool {
+	for _, p := range s.exclude {
+		if p.matches(gvr) {
+			return false
+		}
+	}
+	for _, p := range s.include {
+		if p.matches(gvr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestResourceSelector(t *testing.T) {
+	pods := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	rollouts := schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}
+	virtualServices := schema.GroupVersionResource{Group: "networking.istio.io", Version: "v1beta1", Resource: "virtualservices"}
+	certificates := schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"}
+
+	tests := []struct {
+		name     string
+		include  string
+		exclude  string
+		gvr      schema.GroupVersionResource
+		expected bool
+	}{
+		{"default includes pods", "", "", pods, true},
+		{"default excludes custom resources", "", "", rollouts, false},
+		{"default excludes resources of the same name in other groups", "", "", schema.GroupVersionResource{Group: "serving.knative.dev", Version: "v1", Resource: "services"}, false},
+		{"default includes grouped resources", "", "", schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"}, true},
+		{"core group", "services.core", "", schema.GroupVersionResource{Version: "v1", Resource: "services"}, true},
+		{"group wildcard", "*.argoproj.io", "", rollouts, true},
+		{"group wildcard does not match other groups", "*.argoproj.io", "", certificates, false},
+		{"subdomain wildcard", "*.*.istio.io", "", virtualServices, true},
+		{"subdomain wildcard matches nested groups", "*.*.istio.io", "", schema.GroupVersionResource{Group: "foo.security.istio.io", Version: "v1", Resource: "policies"}, true},
+		{"subdomain wildcard does not match the domain", "*.*.istio.io", "", schema.GroupVersionResource{Group: "istio.io", Version: "v1", Resource: "policies"}, false},
+		{"qualified resource", "virtualservices.networking.istio.io", "", virtualServices, true},
+		{"version constraint", "virtualservices.networking.istio.io/v1", "", virtualServices, false},
+		{"version wildcard", "certificates.cert-manager.io/v*", "", certificates, true},
+		{"exclude wins over include", "*.argoproj.io", "rollouts.argoproj.io", rollouts, false},
+		{"exclude from defaults", "", "secrets", schema.GroupVersionResource{Version: "v1", Resource: "secrets"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newResourceSelector(tt.include, tt.exclude)
+			if got := s.selects(tt.gvr); got != tt.expected {
+				t.Errorf("selects(%s) = %v, expected %v", tt.gvr, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseResourcePatterns(t *testing.T) {
+	patterns := parseResourcePatterns("pods, deployments.apps/v1,,[invalid,/v1")
+	if len(patterns) != 2 {
+		t.Fatalf("Expected 2 valid patterns, got %d: %v", len(patterns), patterns)
+	}
+	if patterns[1] != (resourcePattern{resource: "deployments", group: "apps", version: "v1"}) {
+		t.Errorf("Unexpected pattern: %+v", patterns[1])
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ResourceState describes the state of the watch of a single resource.
+type ResourceState string
+
+const (
+	// StateSyncing means the initial list has not been loaded into the cache yet.
+	StateSyncing ResourceState = "Syncing"
+	// StateSynced means the resource is listed and watched normally.
+	StateSynced ResourceState = "Synced"
+	// StateRetrying means listing or watching failed with a transient error and is being retried.
+	StateRetrying ResourceState = "Retrying"
+	// StateForbidden means the agent is not allowed to list or watch the resource; it is
+	// retried after the next discovery refresh.
+	StateForbidden ResourceState = "Forbidden"
+)
+
+// ResourceStatus is the reported state of the watch of a single resource.
+type ResourceStatus struct {
+	State     ResourceState `json:"state"`
+	Failures  int           `json:"failures,omitempty"`
+	LastError string        `json:"lastError,omitempty"`
+}
+
+// resourceStatus is the internal record behind ResourceStatus.
+type resourceStatus struct {
+	ResourceStatus
+	// synced stays set once the initial list was loaded, even while the watch is retrying.
+	synced bool
+}
+
+// syncTracker records, per watched resource, whether its initial list has been
+// loaded into the object cache and whether its watch is currently failing.
+type syncTracker struct {
+	mu       sync.RWMutex
+	statuses map[schema.GroupVersionResource]*resourceStatus
+}
+
+func newSyncTracker() *syncTracker {
+	return &syncTracker{
+		statuses: make(map[schema.GroupVersionResource]*resourceStatus),
+	}
+}
+
+var syncStatus = newSyncTracker()
+
+// track registers a resource as pending until its initial list completes. A resource that
+// was forbidden keeps reporting it until listing succeeds.
+func (s *syncTracker) track(gvr schema.GroupVersionResource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status, ok := s.statuses[gvr]; ok && status.State == StateForbidden {
+		return
+	}
+	s.statuses[gvr] = &resourceStatus{ResourceStatus: ResourceStatus{State: StateSyncing}}
+}
+
+// untrack forgets a resource that is no longer watched.
+func (s *syncTracker) untrack(gvr schema.GroupVersionResource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.statuses, gvr)
+}
+
+// markSynced marks a tracked resource as synced. Resources that were untracked in the
+// meantime, because their watch was stopped, are left alone.
+func (s *syncTracker) markSynced(gvr schema.GroupVersionResource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status, ok := s.statuses[gvr]; ok {
+		status.synced = true
+		status.State = StateSynced
+	}
+}
+
+// markHealthy clears a previous failure once listing or watching succeeds again.
+func (s *syncTracker) markHealthy(gvr schema.GroupVersionResource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.statuses[gvr]
+	if !ok || (status.State != StateRetrying && status.State != StateForbidden) {
+		return
+	}
+	status.State = StateSyncing
+	if status.synced {
+		status.State = StateSynced
+	}
+	status.Failures = 0
+	status.LastError = ""
+}
+
+// markFailed records a failed list or watch with the state it leaves the resource in.
+func (s *syncTracker) markFailed(gvr schema.GroupVersionResource, state ResourceState, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status, ok := s.statuses[gvr]; ok {
+		status.State = state
+		status.Failures++
+		status.LastError = err.Error()
+	}
+}
+
+func (s *syncTracker) isSynced(gvr schema.GroupVersionResource) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	status, ok := s.statuses[gvr]
+	return ok && status.synced
+}
+
+// allSynced reports whether every tracked resource has completed its initial list.
+// Forbidden resources will never sync and do not hold the agent back.
+func (s *syncTracker) allSynced() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.statuses) == 0 {
+		return false
+	}
+	for _, status := range s.statuses {
+		if !status.synced && status.State != StateForbidden {
+			return false
+		}
+	}
+	return true
+}
+
+// allSettled reports whether every tracked resource has completed its initial list or is
+// failing. Failing resources are retried in the background and reported as degraded, so they
+// do not keep the agent from serving the others.
+func (s *syncTracker) allSettled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.statuses) == 0 {
+		return false
+	}
+	for _, status := range s.statuses {
+		if !status.synced && status.State != StateForbidden && status.State != StateRetrying {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *syncTracker) snapshot() map[string]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	synced := make(map[string]bool, len(s.statuses))
+	for gvr, status := range s.statuses {
+		synced[gvr.String()] = status.synced
+	}
+	return synced
+}
+
+// failing returns the status of every resource whose watch is currently failing.
+func (s *syncTracker) failing() map[string]ResourceStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	failing := make(map[string]ResourceStatus)
+	for gvr, status := range s.statuses {
+		if status.State == StateRetrying || status.State == StateForbidden {
+			failing[gvr.String()] = status.ResourceStatus
+		}
+	}
+	return failing
+}
+
+func (s *syncTracker) statusesSnapshot() map[string]ResourceStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	statuses := make(map[string]ResourceStatus, len(s.statuses))
+	for gvr, status := range s.statuses {
+		statuses[gvr.String()] = status.ResourceStatus
+	}
+	return statuses
+}
+
+func (s *syncTracker) resources() map[schema.GroupVersionResource]ResourceStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	resources := make(map[schema.GroupVersionResource]ResourceStatus, len(s.statuses))
+	for gvr, status := range s.statuses {
+		resources[gvr] = status.ResourceStatus
+	}
+	return resources
+}
+
+// SyncStatus returns the sync state of every watched resource, keyed by its
+// group/version/resource string.
+func SyncStatus() map[string]bool {
+	return syncStatus.snapshot()
+}
+
+// HasSynced reports whether the initial list of every watched resource has been
+// loaded into the object cache, i.e. whether the agent is emitting diffs for all of them.
+func HasSynced() bool {
+	return syncStatus.allSynced()
+}
+
+// IsReady reports whether the agent is ready: every watched resource has been synced, or is
+// failing and reported by FailingResources. A resource that keeps failing, e.g. behind a broken
+// conversion webhook, would otherwise keep a new agent from ever taking over from the old one.
+func IsReady() bool {
+	return syncStatus.allSettled()
+}
+
+// ResourceStatuses returns the watch state of every watched resource, keyed by its
+// group/version/resource string.
+func ResourceStatuses() map[string]ResourceStatus {
+	return syncStatus.statusesSnapshot()
+}
+
+// FailingResources returns the resources whose watch is retrying or has been given up.
+func FailingResources() map[string]ResourceStatus {
+	return syncStatus.failing()
+}
+
+// WatchedResources returns the watch state of every watched resource.
+func WatchedResources() map[schema.GroupVersionResource]ResourceStatus {
+	return syncStatus.resources()
+}
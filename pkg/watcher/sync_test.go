@@ -0,0 +1,89 @@
+// Copyright 2024 Incident Assistant AI
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"errors"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestSyncTracker(t *testing.T) {
+	tracker := newSyncTracker()
+	pods := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+
+	if tracker.allSynced() {
+		t.Fatal("Expected an empty tracker not to report synced")
+	}
+
+	tracker.track(pods)
+	tracker.track(deployments)
+	tracker.markSynced(pods)
+	if tracker.allSynced() {
+		t.Fatal("Expected tracker not to report synced while deployments are pending")
+	}
+
+	tracker.markSynced(deployments)
+	if !tracker.allSynced() {
+		t.Fatal("Expected tracker to report synced once every resource is synced")
+	}
+
+	status := tracker.snapshot()
+	if len(status) != 2 || !status[pods.String()] || !status[deployments.String()] {
+		t.Fatalf("Unexpected sync status: %v", status)
+	}
+	if resources := tracker.resources(); len(resources) != 2 || resources[deployments].State != StateSynced {
+		t.Fatalf("Unexpected watched resources: %v", resources)
+	}
+}
+
+func TestSyncTrackerFailures(t *testing.T) {
+	tracker := newSyncTracker()
+	pods := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+	tracker.track(pods)
+	tracker.markSynced(pods)
+	tracker.markFailed(pods, StateRetrying, errors.New("connection refused"))
+	tracker.markFailed(pods, StateRetrying, errors.New("connection refused"))
+
+	status := tracker.statusesSnapshot()[pods.String()]
+	if status.State != StateRetrying || status.Failures != 2 || status.LastError != "connection refused" {
+		t.Fatalf("Unexpected status while retrying: %+v", status)
+	}
+	if !tracker.isSynced(pods) {
+		t.Fatal("A retrying resource should stay synced")
+	}
+
+	tracker.markHealthy(pods)
+	status = tracker.statusesSnapshot()[pods.String()]
+	if status != (ResourceStatus{State: StateSynced}) {
+		t.Fatalf("Expected the failure to be cleared, got %+v", status)
+	}
+	if len(tracker.failing()) != 0 {
+		t.Fatalf("Expected no failing resources, got %v", tracker.failing())
+	}
+	// A resource that fails before its initial list does not hold back readiness
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	tracker.track(deployments)
+	if tracker.allSettled() {
+		t.Fatal("Expected tracker not to be settled while deployments are pending")
+	}
+	tracker.markFailed(deployments, StateRetrying, errors.New("conversion webhook unavailable"))
+	if tracker.allSynced() || !tracker.allSettled() {
+		t.Fatal("Expected a retrying resource to settle the tracker without syncing it")
+	}
+}
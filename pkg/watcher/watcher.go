@@ -17,54 +17,55 @@ package watcher
 import (
 	"context"
 	"log"
+	"time"
 
 	"github.com/incidentassistant/k8s-agent/pkg/handler"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/cache"
 )
 
-// StartWatching sets up watchers for the specified resources.
+// handleEvent and seedObject receive every informer notification, and forgetObjects is
+// called for every resource that stops being watched. They are variables so tests can
+// observe what the watcher produces.
+var (
+	handleEvent   = handler.HandleEvent
+	seedObject    = handler.Seed
+	forgetObjects = handler.Forget
+)
+
+// StartWatching sets up watchers for the specified resources and keeps them in line
+// with the resources served by the API server as CRDs are installed or removed.
 func StartWatching(client dynamic.Interface, discoveryClient discovery.DiscoveryInterface) {
-	// Discover server-supported API groups and resources
-	apiResourceList, err := discoveryClient.ServerPreferredResources()
+	watchableResources, err := discoverWatchableResources(discoveryClient)
 	if err != nil {
 		log.Fatalf("Failed to discover server-supported API resources: %v", err)
 	}
 
-	// Filter the resources
-	watchableResources := filterWatchableResources(apiResourceList)
-
 	_ = scheme.AddToScheme(scheme.Scheme)
 
-	for _, resource := range watchableResources {
-		go watchResource(client, resource)
-	}
+	reconcileWatches(client, watchableResources)
+
+	go func() {
+		_ = wait.PollUntilContextCancel(context.Background(), time.Second, true, func(context.Context) (bool, error) {
+			return HasSynced(), nil
+		})
+		log.Printf("Initial sync complete for %d resources", len(watchableResources))
+	}()
+
+	go refreshWatches(client, discoveryClient, discoveryRefreshInterval)
 }
 
-// filterWatchableResources filters out the specific resources.
+// filterWatchableResources returns the discovered resources selected by the configured patterns.
 func filterWatchableResources(apiResourceList []*metav1.APIResourceList) []schema.GroupVersionResource {
-	wantedResources := map[string]struct{}{
-		"pods":                   {},
-		"deployments":            {},
-		"statefulsets":           {},
-		"daemonsets":             {},
-		"jobs":                   {},
-		"cronjobs":               {},
-		"services":               {},
-		"ingresses":              {},
-		"networkpolicies":        {},
-		"configmaps":             {},
-		"secrets":                {},
-		"persistentvolumeclaims": {},
-		"roles":                  {},
-		"rolebindings":           {},
-		"clusterroles":           {},
-		"clusterrolebindings":    {},
-	}
-
 	var watchableResources []schema.GroupVersionResource
 	for _, apiResourceGroup := range apiResourceList {
 		gv, err := schema.ParseGroupVersion(apiResourceGroup.GroupVersion)
@@ -74,24 +75,142 @@ func filterWatchableResources(apiResourceList []*metav1.APIResourceList) []schem
 		}
 		for _, apiResource := range apiResourceGroup.APIResources {
 			// Check if the resource is one of the ones we want to watch
-			if _, ok := wantedResources[apiResource.Name]; ok {
-				watchableResources = append(watchableResources, gv.WithResource(apiResource.Name))
+			if gvr := gv.WithResource(apiResource.Name); resourceSelector.selects(gvr) {
+				watchableResources = append(watchableResources, gvr)
 			}
 		}
 	}
 	return watchableResources
 }
 
-// watchResource sets up a watcher for a specific resource.
-func watchResource(client dynamic.Interface, gvr schema.GroupVersionResource) {
-	watcher, err := client.Resource(gvr).Namespace("").Watch(context.Background(), metav1.ListOptions{})
+// watchResource runs an informer for a specific resource until stopCh is closed.
+// The informer lists the resource, watches from the last seen resourceVersion and
+// re-lists whenever the watch is closed or expires (410 Gone), so events keep
+// flowing for the lifetime of the agent instead of stopping at the first disconnect.
+//
+// Objects from the initial list only seed the cache; diffs are emitted once the
+// resource is marked synced.
+//
+// Failures only affect this resource. Transient errors are retried by the informer with
+// exponential backoff, and a forbidden resource or one that no longer exists is dropped so
+// the next discovery refresh can decide on it.
+func watchResource(client dynamic.Interface, gvr schema.GroupVersionResource, stopCh <-chan struct{}) {
+	resourceClient := client.Resource(gvr).Namespace(metav1.NamespaceAll)
+	listWatch := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			list, err := resourceClient.List(context.Background(), options)
+			if err == nil {
+				syncStatus.markHealthy(gvr)
+			}
+			return list, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			w, err := resourceClient.Watch(context.Background(), options)
+			if err == nil {
+				syncStatus.markHealthy(gvr)
+			}
+			return w, err
+		},
+	}
+	informer := cache.NewSharedIndexInformer(listWatch, &unstructured.Unstructured{}, 0, cache.Indexers{})
+
+	// The informer runs until the watch is stopped from outside or gives up on its own
+	informerStopCh := make(chan struct{})
+	giveUp := make(chan struct{}, 1)
+	_ = informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		if handleWatchError(gvr, err) {
+			select {
+			case giveUp <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	registration, err := informer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			if isInInitialList {
+				seed(obj, gvr)
+				return
+			}
+			dispatch(watch.Added, obj, gvr)
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			// Objects of the initial list were seeded, so every update is a change to emit,
+			// including one that arrives before the resource is marked synced
+			dispatch(watch.Modified, newObj, gvr)
+		},
+		DeleteFunc: func(obj interface{}) {
+			dispatch(watch.Deleted, obj, gvr)
+		},
+	})
 	if err != nil {
-		log.Fatalf("Failed to watch %s: %v", gvr.Resource, err)
+		log.Printf("Failed to register event handler for %s: %v", gvr.Resource, err)
+		return
 	}
-	defer watcher.Stop()
 
 	log.Printf("Watching %s", gvr.Resource)
-	for event := range watcher.ResultChan() {
-		handler.HandleEvent(event, gvr)
+	go informer.Run(informerStopCh)
+	defer close(informerStopCh)
+
+	go func() {
+		if cache.WaitForCacheSync(informerStopCh, registration.HasSynced) {
+			syncStatus.markSynced(gvr)
+			log.Printf("Synced %s", gvr.Resource)
+		}
+	}()
+
+	select {
+	case <-stopCh:
+	case <-giveUp:
 	}
 }
+
+// handleWatchError classifies an error returned while listing or watching a resource,
+// records it and reports whether the watch should be given up.
+func handleWatchError(gvr schema.GroupVersionResource, err error) bool {
+	switch {
+	case apierrors.IsResourceExpired(err) || apierrors.IsGone(err):
+		// The informer re-lists from scratch; this is part of normal operation
+		return false
+	case apierrors.IsForbidden(err):
+		log.Printf("Not allowed to watch %s, retrying after the next discovery refresh: %v", gvr, err)
+		syncStatus.markFailed(gvr, StateForbidden, err)
+		stopWatch(gvr)
+		return true
+	case apierrors.IsNotFound(err):
+		log.Printf("Resource %s is not served anymore, stopping its watch: %v", gvr, err)
+		forgetWatch(gvr)
+		return true
+	default:
+		log.Printf("Failed to watch %s, retrying: %v", gvr, err)
+		syncStatus.markFailed(gvr, StateRetrying, err)
+		return false
+	}
+}
+
+// seed stores an object from the initial list in the cache without emitting an event.
+func seed(obj interface{}, gvr schema.GroupVersionResource) {
+	runtimeObj, ok := obj.(runtime.Object)
+	if !ok {
+		log.Printf("Unexpected object type %T for %s", obj, gvr.Resource)
+		return
+	}
+
+	seedObject(runtimeObj, gvr)
+}
+
+// dispatch converts an informer notification into a watch.Event and passes it to the handler.
+// Deletions observed only through a re-list arrive as tombstones and are unwrapped first.
+func dispatch(eventType watch.EventType, obj interface{}, gvr schema.GroupVersionResource) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	runtimeObj, ok := obj.(runtime.Object)
+	if !ok {
+		log.Printf("Unexpected object type %T for %s", obj, gvr.Resource)
+		return
+	}
+
+	handleEvent(watch.Event{Type: eventType, Object: runtimeObj}, gvr)
+}
@@ -15,8 +15,19 @@
 package watcher
 
 import (
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"context"
+	"sync"
 	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
 )
 
 func TestFilterWatchableResources(t *testing.T) {
@@ -37,3 +48,177 @@ func TestFilterWatchableResources(t *testing.T) {
 		t.Fatal("Expected non-zero watchable resources, got zero")
 	}
 }
+
+// recordEvents replaces the handler with one that records every event it receives.
+// Objects seeded from the initial list are recorded as ADDED events in the seeded slice.
+func recordEvents(t *testing.T) (events func() []watch.Event, seeded func() []watch.Event) {
+	var mu sync.Mutex
+	var handled, seeds []watch.Event
+
+	originalHandle, originalSeed := handleEvent, seedObject
+	handleEvent = func(event watch.Event, gvr schema.GroupVersionResource) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, event)
+	}
+	seedObject = func(obj runtime.Object, gvr schema.GroupVersionResource) {
+		mu.Lock()
+		defer mu.Unlock()
+		seeds = append(seeds, watch.Event{Type: watch.Added, Object: obj})
+	}
+	t.Cleanup(func() { handleEvent, seedObject = originalHandle, originalSeed })
+
+	snapshot := func(list *[]watch.Event) func() []watch.Event {
+		return func() []watch.Event {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]watch.Event(nil), *list...)
+		}
+	}
+	return snapshot(&handled), snapshot(&seeds)
+}
+
+func newConfigMap(name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	return obj
+}
+
+func TestWatchResource(t *testing.T) {
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "ConfigMapList"}, newConfigMap("existing"))
+
+	events, seeded := recordEvents(t)
+	syncStatus.track(gvr)
+	defer syncStatus.untrack(gvr)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go watchResource(client, gvr, stopCh)
+
+	// The initial list seeds the cache instead of producing events
+	waitForEvents(t, seeded, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for !syncStatus.isSynced(gvr) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !syncStatus.isSynced(gvr) {
+		t.Fatal("Expected configmaps to be marked synced")
+	}
+	if status := SyncStatus(); !status[gvr.String()] {
+		t.Fatalf("Expected sync status to report configmaps as synced, got %v", status)
+	}
+
+	// Changes made after the initial list must be delivered through the watch
+	if _, err := client.Resource(gvr).Namespace("default").Create(context.Background(), newConfigMap("created"), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create config map: %v", err)
+	}
+	if err := client.Resource(gvr).Namespace("default").Delete(context.Background(), "existing", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete config map: %v", err)
+	}
+
+	got := waitForEvents(t, events, 2)
+	if got[0].Type != watch.Added || got[1].Type != watch.Deleted {
+		t.Fatalf("Expected ADDED then DELETED, got %s then %s", got[0].Type, got[1].Type)
+	}
+}
+
+func TestWatchResourceUpdateAfterInitialList(t *testing.T) {
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "ConfigMapList"}, newConfigMap("existing"))
+
+	events, seeded := recordEvents(t)
+	syncStatus.track(gvr)
+	defer syncStatus.untrack(gvr)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go watchResource(client, gvr, stopCh)
+
+	// An update right after the initial list is emitted even if the sync is not recorded yet
+	waitForEvents(t, seeded, 1)
+	updated := newConfigMap("existing")
+	updated.SetLabels(map[string]string{"version": "2"})
+	if _, err := client.Resource(gvr).Namespace("default").Update(context.Background(), updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update config map: %v", err)
+	}
+
+	if got := waitForEvents(t, events, 1); got[0].Type != watch.Modified {
+		t.Fatalf("Expected MODIFIED, got %s", got[0].Type)
+	}
+}
+
+// waitForEvents polls until at least n events were recorded or the test times out.
+func waitForEvents(t *testing.T, events func() []watch.Event, n int) []watch.Event {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if got := events(); len(got) >= n {
+			return got
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected at least %d events, got %d", n, len(events()))
+	return nil
+}
+
+func TestWatchResourceForbidden(t *testing.T) {
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "SecretList"})
+	client.PrependReactor("list", "secrets", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(gvr.GroupResource(), "", nil)
+	})
+
+	recordEvents(t)
+	syncStatus.track(gvr)
+	defer syncStatus.untrack(gvr)
+	watchesMu.Lock()
+	activeWatches[gvr] = make(chan struct{})
+	watchesMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		watchResource(client, gvr, make(chan struct{}))
+		close(done)
+	}()
+
+	// A forbidden resource gives up on its own instead of retrying forever
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the watch of a forbidden resource to stop")
+	}
+
+	status := ResourceStatuses()[gvr.String()]
+	if status.State != StateForbidden || status.Failures != 1 {
+		t.Fatalf("Expected secrets to be reported as forbidden, got %+v", status)
+	}
+	if _, failing := FailingResources()[gvr.String()]; !failing {
+		t.Fatal("Expected secrets to be reported as failing")
+	}
+	if !syncStatus.allSynced() {
+		t.Fatal("A forbidden resource should not hold back the sync")
+	}
+
+	// The next discovery refresh starts the watch again, still reporting the resource as forbidden
+	watchesMu.Lock()
+	_, active := activeWatches[gvr]
+	watchesMu.Unlock()
+	if active {
+		t.Fatal("Expected the forbidden resource to be dropped from the active watches")
+	}
+	syncStatus.track(gvr)
+	if status := ResourceStatuses()[gvr.String()]; status.State != StateForbidden {
+		t.Fatalf("Expected secrets to be reported as forbidden until listing succeeds, got %+v", status)
+	}
+	syncStatus.markHealthy(gvr)
+	if status := ResourceStatuses()[gvr.String()]; status.State != StateSyncing {
+		t.Fatalf("Expected secrets to be syncing once listing succeeds, got %+v", status)
+	}
+}
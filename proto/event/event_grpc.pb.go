@@ -33,7 +33,11 @@ import (
 const _ = grpc.SupportPackageIsVersion7
 
 const (
-	EventService_EmitEvent_FullMethodName = "/kube_controller_event.EventService/EmitEvent"
+	EventService_EmitEvent_FullMethodName     = "/kube_controller_event.EventService/EmitEvent"
+	EventService_StreamEvents_FullMethodName  = "/kube_controller_event.EventService/StreamEvents"
+	EventService_Connect_FullMethodName       = "/kube_controller_event.EventService/Connect"
+	EventService_RegisterAgent_FullMethodName = "/kube_controller_event.EventService/RegisterAgent"
+	EventService_Heartbeat_FullMethodName     = "/kube_controller_event.EventService/Heartbeat"
 )
 
 // EventServiceClient is the client API for EventService service.
@@ -41,6 +45,17 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type EventServiceClient interface {
 	EmitEvent(ctx context.Context, in *EventMessage, opts ...grpc.CallOption) (*EventResponse, error)
+	// StreamEvents delivers events in batches over a single stream. The hub answers
+	// every batch with an acknowledgement carrying its batchId. Hubs that do not
+	// implement it answer Unimplemented and the agent falls back to EmitEvent.
+	StreamEvents(ctx context.Context, opts ...grpc.CallOption) (EventService_StreamEventsClient, error)
+	// Connect opens a control channel on which the hub sends commands to the agent.
+	// The agent answers every command with a CommandResult carrying its commandId.
+	Connect(ctx context.Context, opts ...grpc.CallOption) (EventService_ConnectClient, error)
+	// RegisterAgent announces the agent to the hub when it starts.
+	RegisterAgent(ctx context.Context, in *AgentInfo, opts ...grpc.CallOption) (*RegisterAgentResponse, error)
+	// Heartbeat is sent periodically so the hub can tell a quiet cluster from a dead agent.
+	Heartbeat(ctx context.Context, in *AgentStatus, opts ...grpc.CallOption) (*HeartbeatResponse, error)
 }
 
 type eventServiceClient struct {
@@ -60,11 +75,102 @@ func (c *eventServiceClient) EmitEvent(ctx context.Context, in *EventMessage, op
 	return out, nil
 }
 
+func (c *eventServiceClient) StreamEvents(ctx context.Context, opts ...grpc.CallOption) (EventService_StreamEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &EventService_ServiceDesc.Streams[0], EventService_StreamEvents_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &eventServiceStreamEventsClient{stream}
+	return x, nil
+}
+
+type EventService_StreamEventsClient interface {
+	Send(*EventBatch) error
+	Recv() (*BatchAck, error)
+	grpc.ClientStream
+}
+
+type eventServiceStreamEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *eventServiceStreamEventsClient) Send(m *EventBatch) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *eventServiceStreamEventsClient) Recv() (*BatchAck, error) {
+	m := new(BatchAck)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *eventServiceClient) Connect(ctx context.Context, opts ...grpc.CallOption) (EventService_ConnectClient, error) {
+	stream, err := c.cc.NewStream(ctx, &EventService_ServiceDesc.Streams[1], EventService_Connect_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &eventServiceConnectClient{stream}
+	return x, nil
+}
+
+type EventService_ConnectClient interface {
+	Send(*CommandResult) error
+	Recv() (*HubCommand, error)
+	grpc.ClientStream
+}
+
+type eventServiceConnectClient struct {
+	grpc.ClientStream
+}
+
+func (x *eventServiceConnectClient) Send(m *CommandResult) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *eventServiceConnectClient) Recv() (*HubCommand, error) {
+	m := new(HubCommand)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *eventServiceClient) RegisterAgent(ctx context.Context, in *AgentInfo, opts ...grpc.CallOption) (*RegisterAgentResponse, error) {
+	out := new(RegisterAgentResponse)
+	err := c.cc.Invoke(ctx, EventService_RegisterAgent_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *eventServiceClient) Heartbeat(ctx context.Context, in *AgentStatus, opts ...grpc.CallOption) (*HeartbeatResponse, error) {
+	out := new(HeartbeatResponse)
+	err := c.cc.Invoke(ctx, EventService_Heartbeat_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // EventServiceServer is the server API for EventService service.
 // All implementations must embed UnimplementedEventServiceServer
 // for forward compatibility
 type EventServiceServer interface {
 	EmitEvent(context.Context, *EventMessage) (*EventResponse, error)
+	// StreamEvents delivers events in batches over a single stream. The hub answers
+	// every batch with an acknowledgement carrying its batchId. Hubs that do not
+	// implement it answer Unimplemented and the agent falls back to EmitEvent.
+	StreamEvents(EventService_StreamEventsServer) error
+	// Connect opens a control channel on which the hub sends commands to the agent.
+	// The agent answers every command with a CommandResult carrying its commandId.
+	Connect(EventService_ConnectServer) error
+	// RegisterAgent announces the agent to the hub when it starts.
+	RegisterAgent(context.Context, *AgentInfo) (*RegisterAgentResponse, error)
+	// Heartbeat is sent periodically so the hub can tell a quiet cluster from a dead agent.
+	Heartbeat(context.Context, *AgentStatus) (*HeartbeatResponse, error)
 	mustEmbedUnimplementedEventServiceServer()
 }
 
@@ -75,6 +181,18 @@ type UnimplementedEventServiceServer struct {
 func (UnimplementedEventServiceServer) EmitEvent(context.Context, *EventMessage) (*EventResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method EmitEvent not implemented")
 }
+func (UnimplementedEventServiceServer) StreamEvents(EventService_StreamEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamEvents not implemented")
+}
+func (UnimplementedEventServiceServer) Connect(EventService_ConnectServer) error {
+	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
+}
+func (UnimplementedEventServiceServer) RegisterAgent(context.Context, *AgentInfo) (*RegisterAgentResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterAgent not implemented")
+}
+func (UnimplementedEventServiceServer) Heartbeat(context.Context, *AgentStatus) (*HeartbeatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
+}
 func (UnimplementedEventServiceServer) mustEmbedUnimplementedEventServiceServer() {}
 
 // UnsafeEventServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -106,6 +224,94 @@ func _EventService_EmitEvent_Handler(srv interface{}, ctx context.Context, dec f
 	return interceptor(ctx, in, info, handler)
 }
 
+func _EventService_StreamEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(EventServiceServer).StreamEvents(&eventServiceStreamEventsServer{stream})
+}
+
+type EventService_StreamEventsServer interface {
+	Send(*BatchAck) error
+	Recv() (*EventBatch, error)
+	grpc.ServerStream
+}
+
+type eventServiceStreamEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *eventServiceStreamEventsServer) Send(m *BatchAck) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *eventServiceStreamEventsServer) Recv() (*EventBatch, error) {
+	m := new(EventBatch)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _EventService_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(EventServiceServer).Connect(&eventServiceConnectServer{stream})
+}
+
+type EventService_ConnectServer interface {
+	Send(*HubCommand) error
+	Recv() (*CommandResult, error)
+	grpc.ServerStream
+}
+
+type eventServiceConnectServer struct {
+	grpc.ServerStream
+}
+
+func (x *eventServiceConnectServer) Send(m *HubCommand) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *eventServiceConnectServer) Recv() (*CommandResult, error) {
+	m := new(CommandResult)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _EventService_RegisterAgent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AgentInfo)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EventServiceServer).RegisterAgent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: EventService_RegisterAgent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EventServiceServer).RegisterAgent(ctx, req.(*AgentInfo))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _EventService_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AgentStatus)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EventServiceServer).Heartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: EventService_Heartbeat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EventServiceServer).Heartbeat(ctx, req.(*AgentStatus))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // EventService_ServiceDesc is the grpc.ServiceDesc for EventService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -117,7 +323,28 @@ var EventService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "EmitEvent",
 			Handler:    _EventService_EmitEvent_Handler,
 		},
+		{
+			MethodName: "RegisterAgent",
+			Handler:    _EventService_RegisterAgent_Handler,
+		},
+		{
+			MethodName: "Heartbeat",
+			Handler:    _EventService_Heartbeat_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamEvents",
+			Handler:       _EventService_StreamEvents_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Connect",
+			Handler:       _EventService_Connect_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "event.proto",
 }